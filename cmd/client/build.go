@@ -0,0 +1,146 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+
+	"github.com/blackss2/devfarm/common"
+	"github.com/blackss2/devfarm/pkg/packer"
+	"github.com/blackss2/devfarm/utils"
+
+	"golang.org/x/net/websocket"
+)
+
+func WaitBuild(Id string, fl *utils.FileList, BuildFlags []string) int {
+	ws, err := websocket.Dial("ws://"+gHostAddr+"/api/spaces/"+Id+"/build", "", "http://"+gHostAddr+"/")
+	if err != nil {
+		panic(err)
+	}
+	defer ws.Close()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt)
+	defer signal.Stop(sigChan)
+	go func() {
+		if _, ok := <-sigChan; ok {
+			fmt.Fprintln(os.Stderr, "devfarm: build canceled")
+			ws.Close()
+			os.Exit(130)
+		}
+	}()
+
+	verbose := hasVerboseFlag(BuildFlags)
+	rewrite := localPathFunc(fl)
+	for {
+		msg := ""
+		err := websocket.Message.Receive(ws, &msg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "devfarm: build session closed:", err)
+			return 1
+		}
+
+		var be common.BuildEvent
+		err = json.Unmarshal([]byte(msg), &be)
+		if err != nil {
+			continue
+		}
+		switch be.Action {
+		case "queued":
+			fmt.Fprintln(os.Stderr, "devfarm: queued at position", be.Position)
+		case "phase":
+			if verbose {
+				fmt.Fprintln(os.Stderr, "devfarm:", be.Phase)
+			}
+		case "output":
+			Output, _ := utils.RewriteDiagnostics(be.Output, rewrite)
+			os.Stderr.WriteString(Output)
+		case "done":
+			if len(be.Error) > 0 {
+				fmt.Fprintln(os.Stderr, "devfarm:", be.Error)
+				return 1
+			}
+			if be.Result != nil && len(be.Result.Reason) > 0 {
+				fmt.Fprintln(os.Stderr, "devfarm: build stopped:", be.Result.Reason)
+			}
+			if be.Result != nil && be.Result.ExitCode != 0 {
+				if be.Result.ExitCode < 0 {
+					return 1
+				}
+				return be.Result.ExitCode
+			}
+			if be.Cached && verbose {
+				fmt.Fprintln(os.Stderr, "devfarm: cached")
+			}
+			return 0
+		}
+	}
+}
+
+func DownloadArtifacts(Id string, Dir string, verbose bool) error {
+	res, err := http.Get("http://" + gHostAddr + "/api/spaces/" + Id + "/artifacts")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return errors.New(string(body))
+	}
+
+	artifacts, err := utils.Spool(res.Body)
+	if err != nil {
+		return err
+	}
+	defer artifacts.Close()
+
+	size, err := artifacts.Size()
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(artifacts, size)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(Dir, 0755)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(zr.File))
+	for _, file := range zr.File {
+		fr, err := file.Open()
+		if err != nil {
+			return err
+		}
+		err = utils.WriteZipEntry(Dir, file.Name, file.Mode(), fr)
+		fr.Close()
+		if err != nil {
+			return err
+		}
+		names = append(names, file.Name)
+		if verbose {
+			fmt.Fprintln(os.Stderr, "devfarm:", filepath.Join(Dir, filepath.FromSlash(file.Name)))
+		}
+	}
+	return utils.CheckSymlinks(Dir, names)
+}
+
+func localPathFunc(fl *utils.FileList) func(File string) string {
+	curDir, _ := os.Getwd()
+	return func(File string) string {
+		path := packer.LocalPath(fl, File)
+		if filepath.IsAbs(path) && len(curDir) > 0 {
+			if rel, err := filepath.Rel(curDir, path); err == nil && !strings.HasPrefix(rel, "..") {
+				return rel
+			}
+		}
+		return path
+	}
+}
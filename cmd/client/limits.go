@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/blackss2/devfarm/common"
+)
+
+var gSizeUnits = []string{"K", "M", "G", "T"}
+
+func isLimitFlag(flag string) bool {
+	switch flag {
+	case "-memory", "-cpus", "-pids", "-write-bps":
+		return true
+	}
+	return false
+}
+
+func parseLimit(Limits *common.RunLimits, flag string, value string) error {
+	var err error
+	switch flag {
+	case "-memory":
+		Limits.MemoryMax, err = parseSize(value)
+	case "-cpus":
+		Limits.CPUs, err = strconv.ParseFloat(value, 64)
+	case "-pids":
+		Limits.PidsMax, err = strconv.ParseInt(value, 10, 64)
+	case "-write-bps":
+		Limits.WriteBps, err = parseSize(value)
+	}
+	return err
+}
+
+// parseSize parses a number of bytes with an optional K, M, G or T suffix (powers of 1024).
+func parseSize(value string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(value), "B")
+	shift := uint(0)
+	for i, unit := range gSizeUnits {
+		if strings.HasSuffix(s, unit) {
+			s = s[:len(s)-1]
+			shift = uint(10 * (i + 1))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %s", value)
+	}
+	return n << shift, nil
+}
+
+func formatSize(n int64) string {
+	if n < 1024 {
+		return strconv.FormatInt(n, 10) + "B"
+	}
+	v := float64(n)
+	unit := ""
+	for _, u := range gSizeUnits {
+		if v < 1024 {
+			break
+		}
+		v /= 1024
+		unit = u
+	}
+	return strconv.FormatFloat(v, 'f', 1, 64) + unit + "B"
+}
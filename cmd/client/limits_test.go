@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+		ok    bool
+	}{
+		{"0", 0, true},
+		{"512", 512, true},
+		{"512B", 512, true},
+		{"4K", 4 << 10, true},
+		{"512m", 512 << 20, true},
+		{"10MB", 10 << 20, true},
+		{"2G", 2 << 30, true},
+		{"1T", 1 << 40, true},
+		{"", 0, false},
+		{"-1M", 0, false},
+		{"1.5G", 0, false},
+		{"1P", 0, false},
+		{"M", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.value)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1.0KB"},
+		{1536, "1.5KB"},
+		{4 << 30, "4.0GB"},
+	}
+	for _, tt := range tests {
+		if got := formatSize(tt.n); got != tt.want {
+			t.Errorf("formatSize(%d) = %s, want %s", tt.n, got, tt.want)
+		}
+	}
+}
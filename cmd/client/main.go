@@ -1,17 +1,17 @@
 package main
 
 import (
-	"bytes"
-	"io/ioutil"
+	"fmt"
 	"net"
-	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/blackss2/devfarm/common"
 	"github.com/blackss2/devfarm/pkg/packer"
-
-	"golang.org/x/net/websocket"
+	"github.com/blackss2/devfarm/pkg/uploader"
 )
 
 const (
@@ -19,179 +19,180 @@ const (
 )
 
 func main() {
-	Command := os.Args[1]
+	CmdArgs := os.Args
+	Args := []string{}
+	for i, v := range CmdArgs {
+		if v == "--" {
+			Args = CmdArgs[i+1:]
+			CmdArgs = CmdArgs[:i]
+			break
+		}
+	}
+
+	Command := CmdArgs[1]
 	BuildFlags := []string{}
-	if len(os.Args) > 3 {
-		BuildFlags = os.Args[2 : len(os.Args)-1]
+	if len(CmdArgs) > 3 {
+		BuildFlags = CmdArgs[2 : len(CmdArgs)-1]
+	}
+	Packages := CmdArgs[len(CmdArgs)-1]
+
+	UseGitIgnore := false
+	ArtifactDir := ""
+	GoVersion := ""
+	Env := []string{}
+	var PortInterval time.Duration
+	var Limits *common.RunLimits
+	for i := 0; i < len(BuildFlags); i++ {
+		if BuildFlags[i] == "-gitignore" {
+			UseGitIgnore = true
+			BuildFlags = append(BuildFlags[:i], BuildFlags[i+1:]...)
+			i--
+		} else if BuildFlags[i] == "-artifacts" && i+1 < len(BuildFlags) {
+			ArtifactDir = BuildFlags[i+1]
+			BuildFlags = append(BuildFlags[:i], BuildFlags[i+2:]...)
+			i--
+		} else if BuildFlags[i] == "-go" && i+1 < len(BuildFlags) {
+			GoVersion = BuildFlags[i+1]
+			BuildFlags = append(BuildFlags[:i], BuildFlags[i+2:]...)
+			i--
+		} else if BuildFlags[i] == "-e" && i+1 < len(BuildFlags) {
+			if !strings.Contains(BuildFlags[i+1], "=") {
+				fmt.Fprintln(os.Stderr, "devfarm: -e needs KEY=VAL:", BuildFlags[i+1])
+				os.Exit(2)
+			}
+			Env = append(Env, BuildFlags[i+1])
+			BuildFlags = append(BuildFlags[:i], BuildFlags[i+2:]...)
+			i--
+		} else if BuildFlags[i] == "-port-interval" && i+1 < len(BuildFlags) {
+			d, err := time.ParseDuration(BuildFlags[i+1])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "devfarm: -port-interval:", err)
+				os.Exit(2)
+			}
+			PortInterval = d
+			BuildFlags = append(BuildFlags[:i], BuildFlags[i+2:]...)
+			i--
+		} else if isLimitFlag(BuildFlags[i]) && i+1 < len(BuildFlags) {
+			if Limits == nil {
+				Limits = &common.RunLimits{}
+			}
+			err := parseLimit(Limits, BuildFlags[i], BuildFlags[i+1])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "devfarm: "+BuildFlags[i]+":", err)
+				os.Exit(2)
+			}
+			BuildFlags = append(BuildFlags[:i], BuildFlags[i+2:]...)
+			i--
+		}
 	}
-	Packages := os.Args[len(os.Args)-1]
 	/*
 		Command := "install"
 		BuildFlags := []string{"-v", "-gcflags", "-N -l"}
 		Packages := "github.com/blackss2/devfarm/cmd/intest"
 	*/
 
-	data, err := packer.PackSourceZip(Command, BuildFlags, Packages)
+	if Command == "matrix" {
+		os.Exit(RunMatrix(BuildFlags, Packages, GoVersion, UseGitIgnore))
+	}
+
+	fl, err := packer.PackSource(Command, BuildFlags, Packages, &packer.Options{
+		GoVersion:    GoVersion,
+		BuildOnly:    len(ArtifactDir) > 0,
+		UseGitIgnore: UseGitIgnore,
+		Args:         Args,
+		Env:          Env,
+		PortInterval: PortInterval,
+		Limits:       Limits,
+		Verbose:      hasVerboseFlag(BuildFlags),
+	})
 	if err != nil {
 		panic(err)
 	}
 
-	res, err := http.Post("http://"+gHostAddr+"/api/spaces", "application/octet-stream", bytes.NewReader(data))
+	um, err := uploader.UploadBlobs(gHostAddr, fl)
 	if err != nil {
 		panic(err)
 	}
-	defer res.Body.Close()
 
-	body, err := ioutil.ReadAll(res.Body)
+	Id, err := uploader.CreateSpace(gHostAddr, um)
 	if err != nil {
 		panic(err)
 	}
-	if res.StatusCode != 200 {
-		panic(string(body))
-	}
 
-	Id := string(body)
-	if len(Id) == 0 {
-		panic("empty id")
+	if Command == "test" {
+		os.Exit(RunTest(Id, BuildFlags))
 	}
 
-	pc := NewPortContext()
-
-	if true {
-		ws, err := websocket.Dial("ws://"+gHostAddr+"/api/spaces/"+Id+"/stdout", "", "http://"+gHostAddr+"/")
-		if err != nil {
-			panic(err)
-		}
-
-		go func() {
-			for {
-				msg := ""
-				err := websocket.Message.Receive(ws, &msg)
-				if err != nil {
-					os.Exit(0)
-					return
-				}
-				os.Stdout.WriteString(msg)
-			}
-		}()
+	if code := WaitBuild(Id, fl, BuildFlags); code != 0 {
+		os.Exit(code)
 	}
-	if true {
-		ws, err := websocket.Dial("ws://"+gHostAddr+"/api/spaces/"+Id+"/stderr", "", "http://"+gHostAddr+"/")
-		if err != nil {
-			panic(err)
-		}
 
-		go func() {
-			for {
-				msg := ""
-				err := websocket.Message.Receive(ws, &msg)
-				if err != nil {
-					os.Exit(0)
-					return
-				}
-				os.Stderr.WriteString(msg)
-			}
-		}()
-	}
-	if true {
-		ws, err := websocket.Dial("ws://"+gHostAddr+"/api/spaces/"+Id+"/portchan", "", "http://"+gHostAddr+"/")
+	if len(ArtifactDir) > 0 {
+		err := DownloadArtifacts(Id, ArtifactDir, hasVerboseFlag(BuildFlags))
 		if err != nil {
 			panic(err)
 		}
-
-		go func() {
-			for {
-				msg := ""
-				err := websocket.Message.Receive(ws, &msg)
-				if err != nil {
-					os.Exit(0)
-					return
-				}
-				list := strings.Split(msg, ",")
-				ports := make([]string, 0, len(list))
-				for _, v := range list {
-					if len(v) > 0 {
-						ports = append(ports, v)
-					}
-				}
-				pc.UpdateListenPorts(ports)
-			}
-		}()
+		return
 	}
-	if true {
-		ws, err := websocket.Dial("ws://"+gHostAddr+"/api/spaces/"+Id+"/stdin", "", "http://"+gHostAddr+"/")
-		if err != nil {
-			panic(err)
-		}
 
-		//go func() {
-		func() {
-			msg := make([]byte, 1000)
-			for {
-				n, err := os.Stdin.Read(msg)
-				if err != nil {
-					os.Exit(0)
-					return
-				}
-
-				err = websocket.Message.Send(ws, msg[:n])
-				if err != nil {
-					os.Exit(0)
-					return
-				}
-			}
-		}()
-	}
+	os.Exit(RunProgram(Id, hasVerboseFlag(BuildFlags), Limits != nil))
 }
 
 type PortContext struct {
 	sync.Mutex
-	portHash   map[string]bool
-	listenHash map[string]net.Listener
+	portHash   map[int]int
+	listenHash map[int]net.Listener
 }
 
 func NewPortContext() *PortContext {
 	pc := &PortContext{
-		portHash:   make(map[string]bool),
-		listenHash: make(map[string]net.Listener),
+		portHash:   make(map[int]int),
+		listenHash: make(map[int]net.Listener),
 	}
 	return pc
 }
 
-func (pc *PortContext) UpdateListenPorts(Ports []string) {
+// OpenPort forwards Port to the server, counting the sockets listening on it.
+func (pc *PortContext) OpenPort(Port int) {
 	pc.Lock()
 	defer pc.Unlock()
 
-	nhash := make(map[string]bool)
-	for k, v := range pc.portHash {
-		nhash[k] = v
-	}
-	for _, v := range Ports {
-		delete(nhash, v)
+	pc.portHash[Port]++
+	if pc.portHash[Port] == 1 {
+		pc.SetupListen(Port)
 	}
-	for _, v := range Ports {
-		if !pc.portHash[v] {
-			pc.SetupListen(v)
-			pc.portHash[v] = true
-		}
+}
+
+func (pc *PortContext) ClosePort(Port int) {
+	pc.Lock()
+	defer pc.Unlock()
+
+	if pc.portHash[Port] == 0 {
+		return
 	}
-	for k, _ := range nhash {
-		if l, has := pc.listenHash[k]; has {
+	pc.portHash[Port]--
+	if pc.portHash[Port] == 0 {
+		delete(pc.portHash, Port)
+		if l, has := pc.listenHash[Port]; has {
 			l.Close()
-			delete(pc.listenHash, k)
+			delete(pc.listenHash, Port)
 		}
 	}
 }
 
-func (pc *PortContext) SetupListen(Port string) {
-	// Listen on TCP port 2000 on all interfaces.
-	l, err := net.Listen("tcp", ":"+Port)
+func (pc *PortContext) SetupListen(Port int) {
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(Port))
 	if err != nil {
 		return
 	}
+	pc.listenHash[Port] = l
+
+	go pc.serve(l, Port)
+}
+
+func (pc *PortContext) serve(l net.Listener, Port int) {
 	defer l.Close()
 
-	pc.listenHash[Port] = l
 	for {
 		// Wait for a connection.
 		local, err := l.Accept()
@@ -199,9 +200,10 @@ func (pc *PortContext) SetupListen(Port string) {
 			return
 		}
 
-		remote, err := net.Dial("tcp", gHostAddr+":"+Port)
+		remote, err := net.Dial("tcp", gHostAddr+":"+strconv.Itoa(Port))
 		if err != nil {
-			return
+			local.Close()
+			continue
 		}
 
 		go func(a net.Conn, b net.Conn) {
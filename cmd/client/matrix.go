@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/blackss2/devfarm/common"
+	"github.com/blackss2/devfarm/pkg/packer"
+	"github.com/blackss2/devfarm/pkg/uploader"
+	"github.com/blackss2/devfarm/utils"
+)
+
+func RunMatrix(BuildFlags []string, Packages string, GoVersions string, UseGitIgnore bool) int {
+	m := &common.Matrix{
+		GoVersions: splitList(GoVersions),
+	}
+	for i := 0; i < len(BuildFlags); i++ {
+		switch {
+		case BuildFlags[i] == "-platforms" && i+1 < len(BuildFlags):
+			m.Platforms = splitList(BuildFlags[i+1])
+		case BuildFlags[i] == "-tagsets" && i+1 < len(BuildFlags):
+			for _, v := range splitList(BuildFlags[i+1]) {
+				if v == "none" {
+					v = ""
+				}
+				m.TagSets = append(m.TagSets, strings.Replace(v, "+", ",", -1))
+			}
+		case BuildFlags[i] == "-test":
+			m.Test = true
+			BuildFlags = append(BuildFlags[:i], BuildFlags[i+1:]...)
+			i--
+			continue
+		default:
+			continue
+		}
+		BuildFlags = append(BuildFlags[:i], BuildFlags[i+2:]...)
+		i--
+	}
+
+	Command := "build"
+	if m.Test {
+		Command = "test"
+	}
+	fl, err := packer.PackSource(Command, BuildFlags, Packages, &packer.Options{
+		UseGitIgnore: UseGitIgnore,
+		Verbose:      hasVerboseFlag(BuildFlags),
+		Targets:      matrixTargets(m),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	um, err := uploader.UploadBlobs(gHostAddr, fl)
+	if err != nil {
+		panic(err)
+	}
+
+	report, err := uploader.RunMatrix(gHostAddr, &common.MatrixRequest{
+		UploadManifest: *um,
+		Matrix:         m,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	rewrite := localPathFunc(fl)
+	for _, v := range report.Cells {
+		name := matrixCellName(v.Cell)
+		switch v.Status {
+		case "passed":
+			if v.Test != nil && len(v.Test.Reason) == 0 {
+				fmt.Printf("ok  \t%s\t(%d passed, %d skipped)\n", name, v.Test.Passed, v.Test.Skipped)
+			} else if v.Test != nil {
+				fmt.Printf("ok  \t%s\t(build only: %s)\n", name, v.Test.Reason)
+			} else {
+				fmt.Printf("ok  \t%s\n", name)
+			}
+		case "failed":
+			fmt.Printf("FAIL\t%s\n", name)
+			if v.Build != nil && len(v.Build.Reason) > 0 {
+				fmt.Printf("\tbuild stopped: %s\n", v.Build.Reason)
+			}
+			if v.Build != nil {
+				Log, _ := utils.RewriteDiagnostics(v.Build.Log, rewrite)
+				os.Stdout.WriteString(Log)
+			}
+			if v.Test != nil {
+				Output, _ := utils.RewriteDiagnostics(v.Test.Output, rewrite)
+				os.Stdout.WriteString(Output)
+				fmt.Printf("\t%d passed, %d failed, %d skipped\n", v.Test.Passed, v.Test.Failed, v.Test.Skipped)
+			}
+		default:
+			fmt.Printf("ERROR\t%s\t%s\n", name, v.Error)
+		}
+	}
+	fmt.Printf("%d passed, %d failed\n", report.Passed, report.Failed)
+
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func matrixTargets(m *common.Matrix) []*utils.BuildTarget {
+	Platforms := m.Platforms
+	if len(Platforms) == 0 {
+		Platforms = []string{""}
+	}
+	targets := make([]*utils.BuildTarget, 0)
+	for _, Platform := range Platforms {
+		target := &utils.BuildTarget{}
+		if idx := strings.Index(Platform, "/"); idx >= 0 {
+			target.GOOS = Platform[:idx]
+			target.GOARCH = Platform[idx+1:]
+		} else {
+			target.GOOS = Platform
+		}
+		if len(m.TagSets) == 0 {
+			targets = append(targets, target)
+			continue
+		}
+		for _, Tags := range m.TagSets {
+			t := *target
+			t.Tags = utils.ParseBuildTags([]string{"-tags", Tags})
+			if t.Tags == nil {
+				t.Tags = []string{}
+			}
+			targets = append(targets, &t)
+		}
+	}
+	return targets
+}
+
+func matrixCellName(cell *common.MatrixCell) string {
+	name := cell.GoVersion
+	if len(cell.GOOS) > 0 || len(cell.GOARCH) > 0 {
+		name += " " + cell.GOOS + "/" + cell.GOARCH
+	}
+	if len(cell.Tags) > 0 {
+		name += " [" + cell.Tags + "]"
+	}
+	return name
+}
+
+func splitList(value string) []string {
+	list := make([]string, 0)
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/blackss2/devfarm/common"
+	"github.com/blackss2/devfarm/utils"
+)
+
+func TestMatrixTargets(t *testing.T) {
+	tests := []struct {
+		m    *common.Matrix
+		want []*utils.BuildTarget
+	}{
+		{&common.Matrix{}, []*utils.BuildTarget{{}}},
+		{
+			&common.Matrix{Platforms: []string{"linux/arm64", "windows"}},
+			[]*utils.BuildTarget{{GOOS: "linux", GOARCH: "arm64"}, {GOOS: "windows"}},
+		},
+		{
+			&common.Matrix{TagSets: []string{"", "integration,extra"}},
+			[]*utils.BuildTarget{{Tags: []string{}}, {Tags: []string{"integration", "extra"}}},
+		},
+	}
+	for _, tt := range tests {
+		got := matrixTargets(tt.m)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("matrixTargets(%+v) = %+v, want %+v", tt.m, got, tt.want)
+		}
+	}
+}
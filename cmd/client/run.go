@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/blackss2/devfarm/common"
+
+	"golang.org/x/net/websocket"
+)
+
+func RunProgram(Id string, verbose bool, limited bool) int {
+	// the outputs are connected before the exit, after which the session is gone
+	var wg sync.WaitGroup
+	for _, v := range []struct {
+		Name string
+		f    *os.File
+	}{{"stdout", os.Stdout}, {"stderr", os.Stderr}} {
+		ws, err := dialSession(Id, v.Name)
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go pipeOutput(&wg, ws, v.f)
+	}
+
+	exitWs, err := dialSession(Id, "exit")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "devfarm: run session closed:", err)
+		return 1
+	}
+	defer exitWs.Close()
+	if verbose {
+		fmt.Fprintln(os.Stderr, "devfarm: session", Id)
+	}
+
+	go watchPorts(Id, NewPortContext(), verbose)
+	go pipeInput(Id)
+
+	msg := ""
+	err = websocket.Message.Receive(exitWs, &msg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "devfarm: run session closed:", err)
+		return 1
+	}
+	wg.Wait()
+
+	var result common.RunResult
+	err = json.Unmarshal([]byte(msg), &result)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "devfarm:", err)
+		return 1
+	}
+	if len(result.Error) > 0 {
+		fmt.Fprintln(os.Stderr, "devfarm:", result.Error)
+	}
+	if len(result.Reason) > 0 {
+		fmt.Fprintln(os.Stderr, "devfarm: program stopped:", result.Reason)
+	}
+	if len(result.LimitsError) > 0 && (verbose || limited) {
+		fmt.Fprintln(os.Stderr, "devfarm: limits not applied:", result.LimitsError)
+	}
+	if len(result.Signal) > 0 {
+		fmt.Fprintln(os.Stderr, "devfarm: program killed by signal:", result.Signal)
+	}
+	if verbose {
+		fmt.Fprintf(os.Stderr, "devfarm: exit code %d after %v\n", result.ExitCode, result.Duration)
+		if u := result.Usage; u != nil {
+			fmt.Fprintf(os.Stderr, "devfarm: peak memory %s, cpu %v (throttled %v), peak pids %d, written %s\n",
+				formatSize(u.MemoryPeak), u.CPUTime, u.CPUThrottled, u.PidsPeak, formatSize(u.WriteBytes))
+		}
+	}
+	if result.ExitCode < 0 {
+		return 1
+	}
+	return result.ExitCode
+}
+
+func dialSession(Id string, Name string) (*websocket.Conn, error) {
+	return websocket.Dial("ws://"+gHostAddr+"/api/spaces/"+Id+"/"+Name, "", "http://"+gHostAddr+"/")
+}
+
+func pipeOutput(wg *sync.WaitGroup, ws *websocket.Conn, f *os.File) {
+	defer wg.Done()
+	defer ws.Close()
+
+	for {
+		msg := ""
+		err := websocket.Message.Receive(ws, &msg)
+		if err != nil {
+			return
+		}
+		f.WriteString(msg)
+	}
+}
+
+// pipeInput and watchPorts end quietly when the session is already gone
+func pipeInput(Id string) {
+	ws, err := dialSession(Id, "stdin")
+	if err != nil {
+		return
+	}
+
+	// the session is closed with the stdin channel, so it is kept open at EOF
+	msg := make([]byte, 1000)
+	for {
+		n, err := os.Stdin.Read(msg)
+		if err != nil {
+			return
+		}
+
+		err = websocket.Message.Send(ws, msg[:n])
+		if err != nil {
+			return
+		}
+	}
+}
+
+func watchPorts(Id string, pc *PortContext, verbose bool) {
+	ws, err := dialSession(Id, "portchan")
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	// a snapshot comes again when the client falls behind, it replaces what is known
+	portHash := make(map[string]*common.ListenPort)
+	for {
+		msg := ""
+		err := websocket.Message.Receive(ws, &msg)
+		if err != nil {
+			return
+		}
+		var pe common.PortEvent
+		err = json.Unmarshal([]byte(msg), &pe)
+		if err != nil {
+			continue
+		}
+
+		// only tcp ports are forwarded
+		switch pe.Action {
+		case "snapshot":
+			current := make(map[string]*common.ListenPort)
+			for _, lp := range pe.Ports {
+				current[lp.String()] = lp
+			}
+			for key, lp := range portHash {
+				if _, has := current[key]; !has && strings.HasPrefix(lp.Proto, "tcp") {
+					pc.ClosePort(lp.Port)
+				}
+			}
+			for key, lp := range current {
+				if _, has := portHash[key]; !has && strings.HasPrefix(lp.Proto, "tcp") {
+					pc.OpenPort(lp.Port)
+				}
+			}
+			portHash = current
+		case "opened":
+			if _, has := portHash[pe.Port.String()]; !has && strings.HasPrefix(pe.Port.Proto, "tcp") {
+				pc.OpenPort(pe.Port.Port)
+			}
+			portHash[pe.Port.String()] = pe.Port
+		case "closed":
+			if _, has := portHash[pe.Port.String()]; has && strings.HasPrefix(pe.Port.Proto, "tcp") {
+				pc.ClosePort(pe.Port.Port)
+			}
+			delete(portHash, pe.Port.String())
+		}
+		if verbose && pe.Port != nil {
+			fmt.Fprintf(os.Stderr, "devfarm: %s %s %d on %s\n", pe.Action, pe.Port.Proto, pe.Port.Port, pe.Port.Addr)
+		}
+	}
+}
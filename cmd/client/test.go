@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/blackss2/devfarm/common"
+
+	"golang.org/x/net/websocket"
+)
+
+func RunTest(Id string, BuildFlags []string) int {
+	ws, err := websocket.Dial("ws://"+gHostAddr+"/api/spaces/"+Id+"/events", "", "http://"+gHostAddr+"/")
+	if err != nil {
+		panic(err)
+	}
+	defer ws.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		for {
+			msg := ""
+			err := websocket.Message.Receive(ws, &msg)
+			if err != nil {
+				pw.Close()
+				return
+			}
+			_, err = pw.Write([]byte(msg + "\n"))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	tr := NewTestRenderer(hasVerboseFlag(BuildFlags))
+	dec := json.NewDecoder(pr)
+	for {
+		var te common.TestEvent
+		err := dec.Decode(&te)
+		if err != nil {
+			break
+		}
+		tr.Render(&te)
+	}
+	pr.Close()
+
+	if tr.failed {
+		return 1
+	}
+	return 0
+}
+
+type TestRenderer struct {
+	verbose    bool
+	failed     bool
+	outputHash map[string][]string
+}
+
+func NewTestRenderer(verbose bool) *TestRenderer {
+	tr := &TestRenderer{
+		verbose:    verbose,
+		outputHash: make(map[string][]string),
+	}
+	return tr
+}
+
+func (tr *TestRenderer) Render(te *common.TestEvent) {
+	key := te.Package + " " + te.Test
+	switch te.Action {
+	case "queued":
+		os.Stderr.WriteString("devfarm: " + te.Output)
+	case "output":
+		if tr.verbose {
+			os.Stdout.WriteString(te.Output)
+		} else if len(te.Test) > 0 {
+			tr.outputHash[key] = append(tr.outputHash[key], te.Output)
+		} else if te.Output != "PASS\n" {
+			os.Stdout.WriteString(te.Output)
+		}
+	case "fail":
+		tr.failed = true
+		if len(te.Test) > 0 && !tr.verbose {
+			os.Stdout.WriteString(strings.Join(tr.outputHash[key], ""))
+		}
+		delete(tr.outputHash, key)
+	case "pass", "skip":
+		delete(tr.outputHash, key)
+	}
+}
+
+func hasVerboseFlag(BuildFlags []string) bool {
+	for _, v := range BuildFlags {
+		if v == "-v" || v == "-v=true" || v == "--v" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/blackss2/devfarm/common"
+	"github.com/blackss2/devfarm/pkg/packer"
+	"github.com/blackss2/devfarm/pkg/uploader"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	gHostAddr = "115.68.218.153"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: devfarm-exec binary [args...]")
+		os.Exit(2)
+	}
+	BinaryPath := os.Args[1]
+	Args := os.Args[2:]
+
+	UseGitIgnore := len(os.Getenv("DEVFARM_GITIGNORE")) > 0
+
+	fl, err := packer.PackBinary(BinaryPath, Args, UseGitIgnore)
+	if err != nil {
+		panic(err)
+	}
+
+	um, err := uploader.UploadBlobs(gHostAddr, fl)
+	if err != nil {
+		panic(err)
+	}
+
+	Id, err := uploader.CreateSpace(gHostAddr, um)
+	if err != nil {
+		panic(err)
+	}
+
+	exitWs, err := websocket.Dial("ws://"+gHostAddr+"/api/spaces/"+Id+"/exit", "", "http://"+gHostAddr+"/")
+	if err != nil {
+		panic(err)
+	}
+	defer exitWs.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go pipeOutput(&wg, Id, "stdout", os.Stdout)
+	go pipeOutput(&wg, Id, "stderr", os.Stderr)
+
+	ws, err := websocket.Dial("ws://"+gHostAddr+"/api/spaces/"+Id+"/stdin", "", "http://"+gHostAddr+"/")
+	if err != nil {
+		panic(err)
+	}
+	go func() {
+		msg := make([]byte, 1000)
+		for {
+			n, err := os.Stdin.Read(msg)
+			if err != nil {
+				return
+			}
+
+			err = websocket.Message.Send(ws, msg[:n])
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	msg := ""
+	err = websocket.Message.Receive(exitWs, &msg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "devfarm-exec:", err)
+		os.Exit(1)
+	}
+	wg.Wait()
+
+	var result common.RunResult
+	err = json.Unmarshal([]byte(msg), &result)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "devfarm-exec:", err)
+		os.Exit(1)
+	}
+	if len(result.Error) > 0 {
+		fmt.Fprintln(os.Stderr, "devfarm-exec:", result.Error)
+	}
+	if len(result.Signal) > 0 {
+		fmt.Fprintln(os.Stderr, "devfarm-exec: killed by signal:", result.Signal)
+	}
+	if result.ExitCode < 0 {
+		os.Exit(1)
+	}
+	os.Exit(result.ExitCode)
+}
+
+func pipeOutput(wg *sync.WaitGroup, Id string, Name string, f *os.File) {
+	defer wg.Done()
+
+	ws, err := websocket.Dial("ws://"+gHostAddr+"/api/spaces/"+Id+"/"+Name, "", "http://"+gHostAddr+"/")
+	if err != nil {
+		panic(err)
+	}
+	defer ws.Close()
+
+	for {
+		msg := ""
+		err := websocket.Message.Receive(ws, &msg)
+		if err != nil {
+			return
+		}
+		f.WriteString(msg)
+	}
+}
@@ -1,15 +1,34 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
-	"io/ioutil"
+	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/blackss2/devfarm/common"
+	"github.com/blackss2/devfarm/pkg/blobstore"
+	"github.com/blackss2/devfarm/pkg/buildcache"
 	"github.com/blackss2/devfarm/pkg/builder"
+	"github.com/blackss2/devfarm/pkg/gocache"
+	"github.com/blackss2/devfarm/pkg/jobqueue"
 	"github.com/blackss2/devfarm/pkg/runner"
+	"github.com/blackss2/devfarm/pkg/sandbox"
+	"github.com/blackss2/devfarm/pkg/toolchain"
+	"github.com/blackss2/devfarm/utils"
 
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
@@ -17,50 +36,501 @@ import (
 	"golang.org/x/net/websocket"
 )
 
+const (
+	gGoCacheMaxSize      = 2 << 30
+	gGoCacheMaxTotalSize = 20 << 30
+	gBuildCacheMaxSize   = 20 << 30
+	gToolchainDir        = "/usr/local/devfarm/toolchains"
+	gJobRetention        = time.Hour
+	gQueuePollInterval   = time.Second
+	gAttachTimeout       = time.Minute
+	gSessionRetention    = time.Minute
+	gPortWaitTimeout     = 30 * time.Second
+	gTrimPath            = true
+
+	gSandboxUid        = 100000
+	gSandboxGid        = 100000
+	gSandboxUids       = 10000
+	gSandboxMemoryMax  = 4 << 30
+	gSandboxCPUs       = 2
+	gSandboxPidsMax    = 1024
+	gSandboxTimeout    = 10 * time.Minute
+	gSandboxCgroupRoot = "/sys/fs/cgroup/devfarm"
+
+	gRunMemoryMax = 4 << 30
+	gRunCPUs      = 2
+	gRunPidsMax   = 1024
+	gRunWriteBps  = 0
+)
+
 func main() {
+	sandbox.Init()
+
 	e := echo.New()
 	e.Use(middleware.Recover())
 
-	RunContextHash := make(map[string]*RunContext)
+	sessions := NewSessions(gSessionRetention)
+
+	store, err := blobstore.NewStore(filepath.Join(os.TempDir(), "devfarm_blobs"))
+	if err != nil {
+		panic(err)
+	}
+
+	cache, err := buildcache.NewCache(filepath.Join(os.TempDir(), "devfarm_buildcache"), gBuildCacheMaxSize)
+	if err != nil {
+		panic(err)
+	}
+
+	goCaches, err := gocache.NewManager(filepath.Join(os.TempDir(), "devfarm_gocache"), gGoCacheMaxSize, gGoCacheMaxTotalSize)
+	if err != nil {
+		panic(err)
+	}
+
+	toolchainDir := os.Getenv("DEVFARM_TOOLCHAINS")
+	if len(toolchainDir) == 0 {
+		toolchainDir = gToolchainDir
+	}
+	toolchains, err := toolchain.NewRegistry(toolchainDir, os.Getenv("GOROOT"))
+	if err != nil {
+		panic(err)
+	}
+	goos, goarch, err := builder.GoPlatform()
+	if err != nil {
+		// the platform of the server itself, a toolchain may still be given per build
+		goos, goarch = runtime.GOOS, runtime.GOARCH
+		fmt.Fprintf(os.Stderr, "devfarm: go env: %v, using %s/%s\n", err, goos, goarch)
+	}
+
+	var sandboxConfig *sandbox.Config
+	if os.Geteuid() == 0 && os.Getenv("DEVFARM_SANDBOX") != "off" {
+		sandboxConfig = &sandbox.Config{
+			Uid:     gSandboxUid,
+			Gid:     gSandboxGid,
+			Uids:    gSandboxUids,
+			Network: os.Getenv("DEVFARM_SANDBOX_NETWORK") == "on",
+			Limits: sandbox.Limits{
+				MemoryMax: gSandboxMemoryMax,
+				CPUs:      gSandboxCPUs,
+				PidsMax:   gSandboxPidsMax,
+			},
+			Timeout:    gSandboxTimeout,
+			CgroupRoot: gSandboxCgroupRoot,
+		}
+	}
+
+	runCgroupRoot := ""
+	if sandbox.CgroupAvailable() {
+		runCgroupRoot = gSandboxCgroupRoot
+	}
+
+	workers, _ := strconv.Atoi(os.Getenv("DEVFARM_WORKERS"))
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	queue := jobqueue.NewQueue(workers, gJobRetention)
+	shared := NewSharedJobs(queue)
+
+	mr := &MatrixRunner{
+		queue:      queue,
+		store:      store,
+		cache:      cache,
+		goCaches:   goCaches,
+		toolchains: toolchains,
+		goos:       goos,
+		goarch:     goarch,
+		sandbox:    sandboxConfig,
+	}
 
 	g := e.Group("/api")
+	g.POST("/blobs/missing", func(c echo.Context) error {
+		var hashes []string
+		err := json.NewDecoder(c.Request().Body).Decode(&hashes)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.JSON(http.StatusOK, store.Missing(hashes))
+	})
+	g.PUT("/blobs/:hash", func(c echo.Context) error {
+		err := store.Put(c.Param("hash"), c.Request().Body)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.NoContent(http.StatusOK)
+	})
+	g.GET("/toolchains", func(c echo.Context) error {
+		err := toolchains.Scan()
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, toolchains.List())
+	})
+	g.GET("/gocaches", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, goCaches.Stats())
+	})
+	g.DELETE("/gocaches/:id", func(c echo.Context) error {
+		err := goCaches.Clear(c.Param("id"))
+		if err != nil {
+			if err == gocache.ErrNotExistCache {
+				return c.String(http.StatusNotFound, err.Error())
+			}
+			return c.String(http.StatusConflict, err.Error())
+		}
+		return c.NoContent(http.StatusOK)
+	})
+	g.GET("/jobs", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, queue.List())
+	})
+	g.GET("/jobs/:id", func(c echo.Context) error {
+		st, err := queue.Get(c.Param("id"))
+		if err != nil {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		return c.JSON(http.StatusOK, st)
+	})
+	g.DELETE("/jobs/:id", func(c echo.Context) error {
+		Id := c.Param("id")
+		if rc, has := sessions.Get(Id); has {
+			// the build goes on while other sessions wait for it
+			if queue.Detach(Id) == nil {
+				rc.cancel()
+				return c.NoContent(http.StatusOK)
+			}
+		}
+		err := queue.Cancel(Id)
+		if err != nil {
+			if err == jobqueue.ErrNotExistJob {
+				return c.String(http.StatusNotFound, err.Error())
+			}
+			return c.String(http.StatusConflict, err.Error())
+		}
+		return c.NoContent(http.StatusOK)
+	})
+	g.POST("/matrix", func(c echo.Context) error {
+		var req common.MatrixRequest
+		err := json.NewDecoder(c.Request().Body).Decode(&req)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if req.Matrix == nil {
+			return c.String(http.StatusBadRequest, ErrEmptyMatrix.Error())
+		}
+		return c.JSON(http.StatusOK, mr.Run(c.Request().Context(), &req))
+	})
 	g.POST("/spaces", func(c echo.Context) error {
-		data, err := ioutil.ReadAll(c.Request().Body)
+		var manifest *common.Manifest
+		var SourceFiles []*common.SourceFile
+		var SourceDigest string
+		closeSource := func() {}
+		if strings.HasPrefix(c.Request().Header.Get("Content-Type"), "application/json") {
+			var um common.UploadManifest
+			err := json.NewDecoder(c.Request().Body).Decode(&um)
+			if err != nil {
+				return c.String(http.StatusBadRequest, err.Error())
+			}
+
+			manifest, SourceFiles, SourceDigest, err = loadBlobSource(store, &um)
+			if err != nil {
+				return c.String(http.StatusBadRequest, err.Error())
+			}
+		} else {
+			source, err := utils.Spool(c.Request().Body)
+			if err != nil {
+				panic(err)
+			}
+
+			size, err := source.Size()
+			if err != nil {
+				source.Close()
+				panic(err)
+			}
+
+			manifest, SourceFiles, err = builder.UnpackSourceZip(source, size)
+			if err != nil {
+				source.Close()
+				return c.String(http.StatusBadRequest, err.Error())
+			}
+			SourceDigest, err = builder.DigestSourceZip(source, size)
+			if err != nil {
+				source.Close()
+				return c.String(http.StatusBadRequest, err.Error())
+			}
+			closeSource = func() {
+				source.Close()
+			}
+		}
+		manifest.SourceDigest = SourceDigest
+
+		if manifest.Command == "exec" {
+			BinaryFiles := make([]*common.BinaryFile, 0, len(SourceFiles))
+			for _, sf := range SourceFiles {
+				BinaryFiles = append(BinaryFiles, &common.BinaryFile{
+					Path:       sf.Path,
+					Mode:       sf.Mode,
+					ReadCloser: sf.ReadCloser,
+				})
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			rc := NewRunContext(ctx, cancel)
+			go func() {
+				defer rc.Close()
+				defer closeSource()
+
+				result, err := runner.RunBinary(ctx, BinaryFiles, runOptions(manifest, runCgroupRoot), rc.stdin, rc.stdout, rc.stderr, rc.ports)
+				rc.Exit(result, err)
+			}()
+			Id := uuid.NewV1().String()
+			sessions.Add(Id, rc)
+
+			return c.String(http.StatusOK, Id)
+		}
+
+		tc, err := lookupToolchain(toolchains, manifest.GoVersion)
 		if err != nil {
-			panic(err)
+			closeSource()
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if !manifest.BuildOnly && isForeign(manifest, goos, goarch) {
+			closeSource()
+			return c.String(http.StatusBadRequest, fmt.Sprintf("%v: %s/%s on %s/%s, build with -artifacts", ErrForeignPlatform, manifest.GOOS, manifest.GOARCH, goos, goarch))
+		}
+
+		if manifest.Command == "test" {
+			err := builder.CheckTestEnv(manifest.Env)
+			if err != nil {
+				closeSource()
+				return c.String(http.StatusBadRequest, err.Error())
+			}
+
+			Id := uuid.NewV1().String()
+			ctx, cancel := context.WithCancel(context.Background())
+			rc := NewRunContext(ctx, cancel)
+			job := queue.Submit(ctx, Id, manifest.User, func(ctx context.Context) error {
+				goCache, release, err := goCaches.Acquire(manifest.User, projectName(manifest))
+				if err != nil {
+					return err
+				}
+				defer release()
+
+				return builder.TestManifest(ctx, manifest, SourceFiles, &builder.Options{
+					GoRoot:   tc.GoRoot,
+					GoCache:  goCache,
+					TrimPath: gTrimPath,
+					Sandbox:  sandboxConfig,
+				}, rc.eventsWriter)
+			})
+			go func() {
+				defer rc.eventsWriter.Close()
+				defer closeSource()
+
+				ew := json.NewEncoder(rc.eventsWriter)
+				err := waitJob(queue, job, func(Position int) {
+					ew.Encode(&common.TestEvent{Time: time.Now(), Action: "queued", Output: fmt.Sprintf("queued at position %d\n", Position)})
+				})
+				if err != nil && err != builder.ErrTestFailed {
+					ew.Encode(&common.TestEvent{Time: time.Now(), Action: "output", Output: err.Error() + "\n"})
+					ew.Encode(&common.TestEvent{Time: time.Now(), Action: "fail"})
+				}
+			}()
+			sessions.Add(Id, rc)
+
+			return c.String(http.StatusOK, Id)
 		}
 
-		binary, err := builder.BuildFromSourceZip(data)
+		key, err := buildcache.Key(manifest, SourceDigest, tc.Version, goos, goarch, gTrimPath)
 		if err != nil {
-			return c.String(http.StatusInternalServerError, err.Error())
+			closeSource()
+			panic(err)
 		}
 
+		Id := uuid.NewV1().String()
 		ctx, cancel := context.WithCancel(context.Background())
 		rc := NewRunContext(ctx, cancel)
+		bw := NewBuildEventWriter(rc.buildWriter)
+		binPath, release, cached := cache.Lookup(key)
 		go func() {
-			defer rc.Close()
+			var err error
+			if !cached {
+				// sessions joining the same build wait on the cache, not in the queue
+				shared.Wait(key, Id, manifest.User)
+				binPath, release, cached, err = cache.Do(ctx, key, rc.buildWriter, func(ctx context.Context, w io.Writer, out io.Writer) error {
+					bw := NewBuildEventWriter(out)
+					job := queue.Submit(ctx, Id, manifest.User, func(ctx context.Context) error {
+						goCache, release, err := goCaches.Acquire(manifest.User, projectName(manifest))
+						if err != nil {
+							return err
+						}
+						defer release()
+
+						_, err = builder.BuildManifest(ctx, manifest, SourceFiles, &builder.Options{
+							GoRoot:   tc.GoRoot,
+							GoCache:  goCache,
+							TrimPath: gTrimPath,
+							Sandbox:  sandboxConfig,
+							Output:   bw,
+							Phase:    bw.Phase,
+						}, w)
+						return err
+					})
+					shared.Start(key, job)
+					defer shared.Finish(key, job)
+
+					return waitJob(queue, job, func(Position int) {
+						bw.Send(&common.BuildEvent{
+							Action:   "queued",
+							Position: Position,
+						})
+					})
+				})
+				shared.Leave(key, Id)
+				if err == context.Canceled {
+					queue.Detach(Id)
+					err = builder.ErrCanceled
+				}
+			}
+			closeSource()
+			if err != nil {
+				be := &common.BuildEvent{
+					Action: "done",
+					Error:  err.Error(),
+				}
+				if e, ok := err.(*builder.BuildError); ok {
+					be.Result = e.Result
+					be.Error = ""
+				}
+				bw.Send(be)
+				rc.Close()
+				return
+			}
+
+			if manifest.BuildOnly {
+				rc.artifact = binPath
+				bw.Send(&common.BuildEvent{
+					Action: "done",
+					Cached: cached,
+				})
+				rc.buildWriter.Close()
+				go rc.watchArtifact(gAttachTimeout, release)
+				return
+			}
+			defer release()
+
+			binary, err := os.Open(binPath)
+			if err != nil {
+				panic(err)
+			}
+			defer binary.Close()
 
-			err := runner.RunFromBinaryZip(ctx, binary, rc.stdin, rc.stdout, rc.stderr, rc.portchan)
+			info, err := binary.Stat()
 			if err != nil {
 				panic(err)
 			}
+			size := info.Size()
+
+			bw.Send(&common.BuildEvent{
+				Action: "done",
+				Cached: cached,
+			})
+			rc.buildWriter.Close()
+
+			defer rc.Close()
+			result, err := runner.RunFromBinaryZip(ctx, binary, size, runOptions(manifest, runCgroupRoot), rc.stdin, rc.stdout, rc.stderr, rc.ports)
+			rc.Exit(result, err)
 		}()
-		Id := uuid.NewV1().String()
-		RunContextHash[Id] = rc
+		sessions.Add(Id, rc)
 
 		return c.String(http.StatusOK, Id)
 	})
+	g.GET("/spaces/:sid/build", func(c echo.Context) error {
+		sid := c.Param("sid")
+		rc, has := sessions.Get(sid)
+		if !has {
+			return c.String(http.StatusNotFound, ErrNotExistSession.Error())
+		}
+		rc.Attach()
+
+		websocket.Handler(func(ws *websocket.Conn) {
+			defer ws.Close()
+
+			built := make(chan struct{})
+			defer close(built)
+			go func() {
+				msg := ""
+				if websocket.Message.Receive(ws, &msg) != nil {
+					select {
+					case <-built:
+					default:
+						rc.Close()
+					}
+				}
+			}()
+
+			scanner := bufio.NewScanner(rc.build)
+			scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+			for scanner.Scan() {
+				err := websocket.Message.Send(ws, scanner.Text())
+				if err != nil {
+					rc.Close()
+					return
+				}
+			}
+			if rc.ctx.Err() != nil {
+				sessions.Remove(sid)
+			}
+		}).ServeHTTP(c.Response(), c.Request())
+		return nil
+	})
+	g.GET("/spaces/:sid/artifacts", func(c echo.Context) error {
+		sid := c.Param("sid")
+		rc, has := sessions.Get(sid)
+		if !has || len(rc.artifact) == 0 {
+			return c.String(http.StatusNotFound, ErrNotExistArtifact.Error())
+		}
+		defer rc.Close()
+		defer sessions.Remove(sid)
+
+		binary, err := os.Open(rc.artifact)
+		if err != nil {
+			panic(err)
+		}
+		defer binary.Close()
+
+		info, err := binary.Stat()
+		if err != nil {
+			panic(err)
+		}
+
+		BinaryFiles, err := runner.UnpackBinaryZip(binary, info.Size())
+		if err != nil {
+			panic(err)
+		}
+
+		c.Response().Header().Set("Content-Type", "application/zip")
+		c.Response().WriteHeader(http.StatusOK)
+		zw := zip.NewWriter(c.Response())
+		for _, bf := range BinaryFiles {
+			if !strings.HasPrefix(bf.Path, "__resources/") {
+				err := utils.CopyToZip(zw, bf.Path, bf.Mode, bf.ReadCloser)
+				if err != nil {
+					return err
+				}
+			}
+			bf.ReadCloser.Close()
+		}
+		return zw.Close()
+	})
 	g.GET("/spaces/:sid/stdin", func(c echo.Context) error {
 		sid := c.Param("sid")
-		rc, has := RunContextHash[sid]
+		rc, has := sessions.Get(sid)
 		if !has {
-			panic("not exist sid")
+			return c.String(http.StatusNotFound, ErrNotExistSession.Error())
 		}
+		rc.Attach()
 
 		websocket.Handler(func(ws *websocket.Conn) {
 			defer ws.Close()
+			// the client keeps stdin open until it goes away
 			defer rc.Close()
-			defer delete(RunContextHash, sid)
 			for {
 				msg := ""
 				err := websocket.Message.Receive(ws, &msg)
@@ -78,15 +548,14 @@ func main() {
 	})
 	g.GET("/spaces/:sid/stdout", func(c echo.Context) error {
 		sid := c.Param("sid")
-		rc, has := RunContextHash[sid]
+		rc, has := sessions.Get(sid)
 		if !has {
-			panic("not exist sid")
+			return c.String(http.StatusNotFound, ErrNotExistSession.Error())
 		}
+		rc.Attach()
 
 		websocket.Handler(func(ws *websocket.Conn) {
 			defer ws.Close()
-			defer rc.Close()
-			defer delete(RunContextHash, sid)
 
 			msg := make([]byte, 1000)
 			for {
@@ -96,6 +565,7 @@ func main() {
 				}
 				err = websocket.Message.Send(ws, string(msg[:n]))
 				if err != nil {
+					rc.Close()
 					return
 				}
 			}
@@ -104,15 +574,14 @@ func main() {
 	})
 	g.GET("/spaces/:sid/stderr", func(c echo.Context) error {
 		sid := c.Param("sid")
-		rc, has := RunContextHash[sid]
+		rc, has := sessions.Get(sid)
 		if !has {
-			panic("not exist sid")
+			return c.String(http.StatusNotFound, ErrNotExistSession.Error())
 		}
+		rc.Attach()
 
 		websocket.Handler(func(ws *websocket.Conn) {
 			defer ws.Close()
-			defer rc.Close()
-			defer delete(RunContextHash, sid)
 
 			msg := make([]byte, 1000)
 			for {
@@ -122,31 +591,99 @@ func main() {
 				}
 				err = websocket.Message.Send(ws, string(msg[:n]))
 				if err != nil {
+					rc.Close()
 					return
 				}
 			}
 		}).ServeHTTP(c.Response(), c.Request())
 		return nil
 	})
-	g.GET("/spaces/:sid/portchan", func(c echo.Context) error {
+	g.GET("/spaces/:sid/events", func(c echo.Context) error {
 		sid := c.Param("sid")
-		rc, has := RunContextHash[sid]
+		rc, has := sessions.Get(sid)
 		if !has {
-			panic("not exist sid")
+			return c.String(http.StatusNotFound, ErrNotExistSession.Error())
 		}
+		rc.Attach()
 
 		websocket.Handler(func(ws *websocket.Conn) {
 			defer ws.Close()
 			defer rc.Close()
-			defer delete(RunContextHash, sid)
 
-			msg := make([]byte, 1000)
-			for {
-				n, err := rc.portchan.Read(msg)
+			scanner := bufio.NewScanner(rc.events)
+			scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+			for scanner.Scan() {
+				err := websocket.Message.Send(ws, scanner.Text())
 				if err != nil {
 					return
 				}
-				err = websocket.Message.Send(ws, string(msg[:n]))
+			}
+			sessions.Remove(sid)
+		}).ServeHTTP(c.Response(), c.Request())
+		return nil
+	})
+	g.GET("/spaces/:sid/exit", func(c echo.Context) error {
+		sid := c.Param("sid")
+		rc, has := sessions.Get(sid)
+		if !has {
+			return c.String(http.StatusNotFound, ErrNotExistSession.Error())
+		}
+		rc.Attach()
+
+		websocket.Handler(func(ws *websocket.Conn) {
+			defer ws.Close()
+
+			select {
+			case <-rc.exited:
+			case <-rc.ctx.Done():
+			}
+			result := &common.RunResult{
+				ExitCode: -1,
+				Error:    ErrSessionClosed.Error(),
+			}
+			select {
+			case <-rc.exited:
+				result = rc.result
+			default:
+			}
+			data, err := json.Marshal(result)
+			if err != nil {
+				panic(err)
+			}
+			if websocket.Message.Send(ws, string(data)) == nil {
+				sessions.Remove(sid)
+			}
+		}).ServeHTTP(c.Response(), c.Request())
+		return nil
+	})
+	g.GET("/spaces/:sid/portchan", func(c echo.Context) error {
+		sid := c.Param("sid")
+		rc, has := sessions.Get(sid)
+		if !has {
+			return c.String(http.StatusNotFound, ErrNotExistSession.Error())
+		}
+		rc.Attach()
+
+		websocket.Handler(func(ws *websocket.Conn) {
+			defer ws.Close()
+
+			snapshot, ch := rc.ports.Subscribe()
+			defer rc.ports.Unsubscribe(ch)
+
+			data, err := json.Marshal(snapshot)
+			if err != nil {
+				panic(err)
+			}
+			err = websocket.Message.Send(ws, string(data))
+			if err != nil {
+				return
+			}
+			for pe := range ch {
+				data, err := json.Marshal(pe)
+				if err != nil {
+					panic(err)
+				}
+				err = websocket.Message.Send(ws, string(data))
 				if err != nil {
 					return
 				}
@@ -154,13 +691,180 @@ func main() {
 		}).ServeHTTP(c.Response(), c.Request())
 		return nil
 	})
+	g.GET("/spaces/:sid/ports", func(c echo.Context) error {
+		rc, has := sessions.Get(c.Param("sid"))
+		if !has {
+			return c.String(http.StatusNotFound, ErrNotExistSession.Error())
+		}
+		return c.JSON(http.StatusOK, rc.ports.Ports())
+	})
+	g.GET("/spaces/:sid/ports/wait", func(c echo.Context) error {
+		rc, has := sessions.Get(c.Param("sid"))
+		if !has {
+			return c.String(http.StatusNotFound, ErrNotExistSession.Error())
+		}
+		Port, err := strconv.Atoi(c.QueryParam("port"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		timeout := gPortWaitTimeout
+		if v := c.QueryParam("timeout"); len(v) > 0 {
+			timeout, err = time.ParseDuration(v)
+			if err != nil {
+				return c.String(http.StatusBadRequest, err.Error())
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+		defer cancel()
+		lp, err := rc.ports.Wait(ctx, Port)
+		if err != nil {
+			if err == ErrSessionClosed {
+				return c.String(http.StatusGone, err.Error())
+			}
+			return c.String(http.StatusRequestTimeout, err.Error())
+		}
+		return c.JSON(http.StatusOK, lp)
+	})
 	e.Start(":80")
 }
 
 var (
-	ErrChanClosed = errors.New("chan closed")
+	ErrChanClosed       = errors.New("chan closed")
+	ErrNotExistBlob     = errors.New("not exist blob")
+	ErrNotExistArtifact = errors.New("not exist artifact")
+	ErrEmptyMatrix      = errors.New("empty matrix")
+	ErrSessionClosed    = errors.New("session closed")
+	ErrNotExistSession  = errors.New("not exist session")
+	ErrForeignPlatform  = errors.New("can not run a binary of another platform")
 )
 
+func lookupToolchain(toolchains *toolchain.Registry, Version string) (*toolchain.Toolchain, error) {
+	tc, err := toolchains.Lookup(Version)
+	if err == toolchain.ErrNotExistToolchain {
+		err = toolchains.Scan()
+		if err != nil {
+			return nil, err
+		}
+		tc, err = toolchains.Lookup(Version)
+	}
+	if err != nil {
+		versions := make([]string, 0)
+		for _, v := range toolchains.List() {
+			versions = append(versions, v.Version)
+		}
+		return nil, fmt.Errorf("%v: %s (available: %s)", err, Version, strings.Join(versions, ", "))
+	}
+	return tc, nil
+}
+
+func waitJob(queue *jobqueue.Queue, job *jobqueue.Job, queued func(Position int)) error {
+	ticker := time.NewTicker(gQueuePollInterval)
+	defer ticker.Stop()
+
+	last := 0
+	for {
+		st, err := queue.Get(job.Id())
+		if err == nil && st.State == jobqueue.StateQueued && st.Position != last {
+			last = st.Position
+			queued(st.Position)
+		}
+		select {
+		case <-job.Done():
+			err := job.Err()
+			if err == context.Canceled {
+				return builder.ErrCanceled
+			}
+			return err
+		case <-ticker.C:
+		}
+	}
+}
+
+// runOptions always asks for the run limits, DEVFARM_SANDBOX only concerns builds; CgroupRoot is empty without cgroups.
+func runOptions(manifest *common.Manifest, CgroupRoot string) *runner.Options {
+	opts := &runner.Options{
+		Args:         manifest.Args,
+		Env:          manifest.Env,
+		PortInterval: manifest.PortInterval,
+		Limits:       runLimits(manifest.Limits),
+		CgroupRoot:   CgroupRoot,
+	}
+	return opts
+}
+
+// runLimits applies the limits asked by the run spec within the ones of the server.
+func runLimits(l *common.RunLimits) sandbox.Limits {
+	limits := sandbox.Limits{
+		MemoryMax: gRunMemoryMax,
+		CPUs:      gRunCPUs,
+		PidsMax:   gRunPidsMax,
+		WriteBps:  gRunWriteBps,
+	}
+	if l == nil {
+		return limits
+	}
+	if l.MemoryMax > 0 && l.MemoryMax < limits.MemoryMax {
+		limits.MemoryMax = l.MemoryMax
+	}
+	if l.CPUs > 0 && l.CPUs < limits.CPUs {
+		limits.CPUs = l.CPUs
+	}
+	if l.PidsMax > 0 && l.PidsMax < limits.PidsMax {
+		limits.PidsMax = l.PidsMax
+	}
+	if l.WriteBps > 0 && (limits.WriteBps == 0 || l.WriteBps < limits.WriteBps) {
+		limits.WriteBps = l.WriteBps
+	}
+	return limits
+}
+
+// isForeign tells if the binaries built for manifest can not run on the server.
+func isForeign(manifest *common.Manifest, goos string, goarch string) bool {
+	return (len(manifest.GOOS) > 0 && manifest.GOOS != goos) || (len(manifest.GOARCH) > 0 && manifest.GOARCH != goarch)
+}
+
+func projectName(manifest *common.Manifest) string {
+	if len(manifest.Module) > 0 {
+		return manifest.Module
+	}
+	return manifest.Packages
+}
+
+func loadBlobSource(store *blobstore.Store, um *common.UploadManifest) (*common.Manifest, []*common.SourceFile, string, error) {
+	paths := make([]string, 0, len(um.Files))
+	files := make(map[string]string)
+	for path, hash := range um.Files {
+		if !store.Has(hash) {
+			return nil, nil, "", fmt.Errorf("%v: %s for %s", ErrNotExistBlob, hash, path)
+		}
+		paths = append(paths, path)
+		if path != "manifest.json" {
+			files[path] = hash
+		}
+	}
+	sort.Strings(paths)
+
+	SourceFiles := make([]*common.SourceFile, 0, len(paths))
+	for _, path := range paths {
+		mode, has := um.Modes[path]
+		if !has {
+			mode = 0644
+		}
+		SourceFiles = append(SourceFiles, &common.SourceFile{
+			Path:       path,
+			Mode:       mode,
+			ReadCloser: store.LazyOpen(um.Files[path]),
+		})
+	}
+
+	manifest, SourceFiles, err := builder.UnpackSourceFiles(SourceFiles)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return manifest, SourceFiles, utils.DigestFiles(files, um.Modes), nil
+}
+
 type ChanReadWriter struct {
 	sync.Mutex
 	waitChan chan struct{}
@@ -181,6 +885,11 @@ func NewChanReadWriter() *ChanReadWriter {
 func (cr *ChanReadWriter) Read(bs []byte) (int, error) {
 	select {
 	case <-cr.done:
+		cr.Lock()
+		defer cr.Unlock()
+		if cr.buffer.Len() > 0 {
+			return cr.buffer.Read(bs)
+		}
 		return 0, ErrChanClosed
 	case <-cr.waitChan:
 		cr.Lock()
@@ -200,9 +909,7 @@ func (cr *ChanReadWriter) Read(bs []byte) (int, error) {
 			for i, b := range cbs {
 				bs[i] = b
 			}
-			go func() {
-				cr.waitChan <- struct{}{}
-			}()
+			go cr.notify()
 			return len(cbs), nil
 		}
 	}
@@ -210,51 +917,167 @@ func (cr *ChanReadWriter) Read(bs []byte) (int, error) {
 
 func (cr *ChanReadWriter) Write(bs []byte) (int, error) {
 	cr.Lock()
-	defer func() {
+	if !cr.isOpen {
 		cr.Unlock()
-		if cr.isOpen {
-			cr.waitChan <- struct{}{}
-		}
-	}()
+		return 0, ErrChanClosed
+	}
 	n, err := cr.buffer.Write(bs)
+	cr.Unlock()
 	if err != nil {
 		return 0, err
 	}
-	return n, err
+	cr.notify()
+	return n, nil
+}
+
+// notify wakes a reader, waitChan is never closed so a late writer can't panic on it.
+func (cr *ChanReadWriter) notify() {
+	select {
+	case cr.waitChan <- struct{}{}:
+	case <-cr.done:
+	}
 }
 
 func (cr *ChanReadWriter) Close() {
+	cr.Lock()
+	defer cr.Unlock()
+
 	if cr.isOpen {
-		close(cr.waitChan)
 		close(cr.done)
 		cr.isOpen = false
 	}
 }
 
+type BuildEventWriter struct {
+	sync.Mutex
+	enc *json.Encoder
+}
+
+func NewBuildEventWriter(w io.Writer) *BuildEventWriter {
+	bw := &BuildEventWriter{
+		enc: json.NewEncoder(w),
+	}
+	return bw
+}
+
+func (bw *BuildEventWriter) Send(be *common.BuildEvent) error {
+	bw.Lock()
+	defer bw.Unlock()
+	be.Time = time.Now()
+	return bw.enc.Encode(be)
+}
+
+func (bw *BuildEventWriter) Write(bs []byte) (int, error) {
+	err := bw.Send(&common.BuildEvent{
+		Action: "output",
+		Output: string(bs),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(bs), nil
+}
+
+func (bw *BuildEventWriter) Phase(Phase string) {
+	bw.Send(&common.BuildEvent{
+		Action: "phase",
+		Phase:  Phase,
+	})
+}
+
 type RunContext struct {
-	stdin    *ChanReadWriter
-	stdout   *ChanReadWriter
-	stderr   *ChanReadWriter
-	portchan *ChanReadWriter
-	ctx      context.Context
-	cancel   context.CancelFunc
+	stdin        *ChanReadWriter
+	stdout       *ChanReadWriter
+	stderr       *ChanReadWriter
+	ports        *PortHub
+	events       *io.PipeReader
+	eventsWriter *io.PipeWriter
+	build        *io.PipeReader
+	buildWriter  *io.PipeWriter
+	artifact     string
+	attached     chan struct{}
+	attachOnce   sync.Once
+	closeOnce    sync.Once
+	exited       chan struct{}
+	result       *common.RunResult
+	ctx          context.Context
+	cancel       context.CancelFunc
 }
 
 func NewRunContext(ctx context.Context, cancel context.CancelFunc) *RunContext {
+	events, eventsWriter := io.Pipe()
+	build, buildWriter := io.Pipe()
 	rc := &RunContext{
-		stdin:    NewChanReadWriter(),
-		stdout:   NewChanReadWriter(),
-		stderr:   NewChanReadWriter(),
-		portchan: NewChanReadWriter(),
-		ctx:      ctx,
-		cancel:   cancel,
+		stdin:        NewChanReadWriter(),
+		stdout:       NewChanReadWriter(),
+		stderr:       NewChanReadWriter(),
+		ports:        NewPortHub(),
+		events:       events,
+		eventsWriter: eventsWriter,
+		build:        build,
+		buildWriter:  buildWriter,
+		attached:     make(chan struct{}),
+		exited:       make(chan struct{}),
+		ctx:          ctx,
+		cancel:       cancel,
 	}
+	go rc.watchAttach(gAttachTimeout)
 	return rc
 }
 
+func (rc *RunContext) Attach() {
+	rc.attachOnce.Do(func() {
+		close(rc.attached)
+	})
+}
+
+// watchAttach cancels the session when no client connects to it in time.
+func (rc *RunContext) watchAttach(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-rc.attached:
+	case <-rc.ctx.Done():
+	case <-timer.C:
+		rc.Close()
+	}
+}
+
+// watchArtifact closes a build-only session whose artifacts are not fetched in time.
+// The artifact is kept in the cache until then.
+func (rc *RunContext) watchArtifact(timeout time.Duration, release func()) {
+	defer release()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-rc.ctx.Done():
+	case <-timer.C:
+		rc.Close()
+	}
+}
+
+func (rc *RunContext) Exit(result *common.RunResult, err error) {
+	if err != nil {
+		result = &common.RunResult{
+			ExitCode: -1,
+			Error:    err.Error(),
+		}
+	}
+	rc.result = result
+	close(rc.exited)
+}
+
 func (rc *RunContext) Close() {
-	rc.stdin.Close()
-	rc.stdout.Close()
-	rc.stderr.Close()
-	rc.cancel()
+	rc.closeOnce.Do(func() {
+		rc.cancel()
+		rc.stdin.Close()
+		rc.stdout.Close()
+		rc.stderr.Close()
+		rc.ports.Close()
+		rc.events.Close()
+		rc.build.Close()
+	})
 }
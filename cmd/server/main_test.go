@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/blackss2/devfarm/common"
+	"github.com/blackss2/devfarm/pkg/sandbox"
+)
+
+func TestRunLimits(t *testing.T) {
+	defaults := sandbox.Limits{
+		MemoryMax: gRunMemoryMax,
+		CPUs:      gRunCPUs,
+		PidsMax:   gRunPidsMax,
+		WriteBps:  gRunWriteBps,
+	}
+	tests := []struct {
+		l    *common.RunLimits
+		want sandbox.Limits
+	}{
+		{nil, defaults},
+		{&common.RunLimits{}, defaults},
+		{&common.RunLimits{MemoryMax: 512 << 20, CPUs: 0.5, PidsMax: 64, WriteBps: 10 << 20},
+			sandbox.Limits{MemoryMax: 512 << 20, CPUs: 0.5, PidsMax: 64, WriteBps: 10 << 20}},
+		// the limits of the server can't be raised
+		{&common.RunLimits{MemoryMax: 64 << 30, CPUs: 16, PidsMax: 1 << 20}, defaults},
+	}
+	for _, tt := range tests {
+		if got := runLimits(tt.l); got != tt.want {
+			t.Errorf("runLimits(%+v) = %+v, want %+v", tt.l, got, tt.want)
+		}
+	}
+}
+
+func TestRunOptions(t *testing.T) {
+	manifest := &common.Manifest{
+		Limits: &common.RunLimits{PidsMax: 8},
+	}
+	// the limits don't depend on the build sandbox
+	opts := runOptions(manifest, "")
+	if opts.Limits.PidsMax != 8 || len(opts.CgroupRoot) != 0 {
+		t.Errorf("runOptions without cgroups = %+v", opts)
+	}
+	opts = runOptions(manifest, gSandboxCgroupRoot)
+	if opts.Limits.PidsMax != 8 || opts.CgroupRoot != gSandboxCgroupRoot {
+		t.Errorf("runOptions with cgroups = %+v", opts)
+	}
+}
+
+func TestChanReadWriterClose(t *testing.T) {
+	cr := NewChanReadWriter()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// nobody reads, Close lets it go
+		cr.Write([]byte("a"))
+	}()
+	cr.Close()
+	cr.Close()
+	<-done
+	if _, err := cr.Write([]byte("b")); err != ErrChanClosed {
+		t.Errorf("write after close = %v", err)
+	}
+
+	bs := make([]byte, 8)
+	n, _ := cr.Read(bs)
+	if n > 0 && string(bs[:n]) != "a" {
+		t.Errorf("read = %q", bs[:n])
+	}
+	if _, err := cr.Read(bs); err != ErrChanClosed {
+		t.Errorf("read after close = %v", err)
+	}
+
+	rc := NewRunContext(context.WithCancel(context.Background()))
+	rc.Close()
+	rc.Close()
+}
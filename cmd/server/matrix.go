@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/blackss2/devfarm/common"
+	"github.com/blackss2/devfarm/pkg/blobstore"
+	"github.com/blackss2/devfarm/pkg/buildcache"
+	"github.com/blackss2/devfarm/pkg/builder"
+	"github.com/blackss2/devfarm/pkg/gocache"
+	"github.com/blackss2/devfarm/pkg/jobqueue"
+	"github.com/blackss2/devfarm/pkg/sandbox"
+	"github.com/blackss2/devfarm/pkg/toolchain"
+
+	"github.com/satori/go.uuid"
+)
+
+const (
+	gMatrixWorkers = 4
+)
+
+type MatrixRunner struct {
+	queue      *jobqueue.Queue
+	store      *blobstore.Store
+	cache      *buildcache.Cache
+	goCaches   *gocache.Manager
+	toolchains *toolchain.Registry
+	goos       string
+	goarch     string
+	sandbox    *sandbox.Config
+}
+
+func (mr *MatrixRunner) Run(ctx context.Context, req *common.MatrixRequest) *common.MatrixReport {
+	cells := expandMatrix(req.Matrix)
+
+	report := &common.MatrixReport{
+		Cells: make([]*common.MatrixCellResult, len(cells)),
+	}
+	sem := make(chan struct{}, gMatrixWorkers)
+	var wg sync.WaitGroup
+	for i, cell := range cells {
+		wg.Add(1)
+		go func(i int, cell *common.MatrixCell) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() {
+				<-sem
+			}()
+			report.Cells[i] = mr.runCell(ctx, req, cell)
+		}(i, cell)
+	}
+	wg.Wait()
+
+	for _, v := range report.Cells {
+		if v.Status == "passed" {
+			report.Passed++
+		} else {
+			report.Failed++
+		}
+	}
+	return report
+}
+
+func (mr *MatrixRunner) runCell(ctx context.Context, req *common.MatrixRequest, cell *common.MatrixCell) *common.MatrixCellResult {
+	res := &common.MatrixCellResult{
+		Cell: cell,
+	}
+	fail := func(err error) *common.MatrixCellResult {
+		res.Status = "error"
+		res.Error = err.Error()
+		return res
+	}
+
+	manifest, SourceFiles, SourceDigest, err := loadBlobSource(mr.store, &req.UploadManifest)
+	if err != nil {
+		return fail(err)
+	}
+
+	tc, err := lookupToolchain(mr.toolchains, cell.GoVersion)
+	if err != nil {
+		return fail(err)
+	}
+	cell.GoVersion = tc.Version
+
+	bm := *manifest
+	bm.Command = "build"
+	bm.GoVersion = tc.Version
+	bm.GOOS = cell.GOOS
+	bm.GOARCH = cell.GOARCH
+	if len(req.Matrix.TagSets) > 0 {
+		bm.BuildFlags = withTags(manifest.BuildFlags, cell.Tags)
+	}
+	bm.BuildOnly = true
+	bm.SourceDigest = SourceDigest
+
+	key, err := buildcache.Key(&bm, SourceDigest, tc.Version, mr.goos, mr.goarch, gTrimPath)
+	if err != nil {
+		return fail(err)
+	}
+	_, release, _, err := mr.cache.Do(ctx, key, nil, func(ctx context.Context, w io.Writer, out io.Writer) error {
+		return mr.queue.Run(ctx, uuid.NewV1().String(), bm.User, func(ctx context.Context) error {
+			goCache, release, err := mr.goCaches.Acquire(bm.User, projectName(&bm))
+			if err != nil {
+				return err
+			}
+			defer release()
+
+			_, err = builder.BuildManifest(ctx, &bm, SourceFiles, &builder.Options{
+				GoRoot:   tc.GoRoot,
+				GoCache:  goCache,
+				TrimPath: gTrimPath,
+				Sandbox:  mr.sandbox,
+			}, w)
+			return err
+		})
+	})
+	if err != nil {
+		if be, ok := err.(*builder.BuildError); ok {
+			res.Status = "failed"
+			res.Build = be.Result
+			return res
+		}
+		return fail(err)
+	}
+	release()
+
+	res.Status = "passed"
+	if !req.Matrix.Test {
+		return res
+	}
+	if isForeign(&bm, mr.goos, mr.goarch) {
+		res.Test = &common.TestSummary{
+			Reason: "tests are run only for " + mr.goos + "/" + mr.goarch,
+		}
+		return res
+	}
+
+	_, SourceFiles, _, err = loadBlobSource(mr.store, &req.UploadManifest)
+	if err != nil {
+		return fail(err)
+	}
+	tm := bm
+	tm.Command = "test"
+	tm.BuildOnly = false
+
+	var events bytes.Buffer
+	err = mr.queue.Run(ctx, uuid.NewV1().String(), tm.User, func(ctx context.Context) error {
+		goCache, release, err := mr.goCaches.Acquire(tm.User, projectName(&tm))
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		return builder.TestManifest(ctx, &tm, SourceFiles, &builder.Options{
+			GoRoot:   tc.GoRoot,
+			GoCache:  goCache,
+			TrimPath: gTrimPath,
+			Sandbox:  mr.sandbox,
+		}, &events)
+	})
+	res.Test = summarizeTests(events.Bytes())
+	if err != nil {
+		if err == builder.ErrTestFailed {
+			res.Status = "failed"
+			return res
+		}
+		return fail(err)
+	}
+	return res
+}
+
+func expandMatrix(m *common.Matrix) []*common.MatrixCell {
+	GoVersions := m.GoVersions
+	if len(GoVersions) == 0 {
+		GoVersions = []string{""}
+	}
+	Platforms := m.Platforms
+	if len(Platforms) == 0 {
+		Platforms = []string{""}
+	}
+	TagSets := m.TagSets
+	if len(TagSets) == 0 {
+		TagSets = []string{""}
+	}
+
+	cells := make([]*common.MatrixCell, 0, len(GoVersions)*len(Platforms)*len(TagSets))
+	for _, GoVersion := range GoVersions {
+		for _, Platform := range Platforms {
+			for _, Tags := range TagSets {
+				cell := &common.MatrixCell{
+					GoVersion: GoVersion,
+					Tags:      Tags,
+				}
+				if idx := strings.Index(Platform, "/"); idx >= 0 {
+					cell.GOOS = Platform[:idx]
+					cell.GOARCH = Platform[idx+1:]
+				} else {
+					cell.GOOS = Platform
+				}
+				cells = append(cells, cell)
+			}
+		}
+	}
+	return cells
+}
+
+func withTags(BuildFlags []string, Tags string) []string {
+	flags := make([]string, 0, len(BuildFlags)+2)
+	for i := 0; i < len(BuildFlags); i++ {
+		v := BuildFlags[i]
+		if v == "-tags" || v == "--tags" {
+			i++
+			continue
+		}
+		if strings.HasPrefix(v, "-tags=") || strings.HasPrefix(v, "--tags=") {
+			continue
+		}
+		flags = append(flags, v)
+	}
+	if len(Tags) > 0 {
+		flags = append(flags, "-tags", Tags)
+	}
+	return flags
+}
+
+func summarizeTests(data []byte) *common.TestSummary {
+	ts := &common.TestSummary{}
+	outputHash := make(map[string][]string)
+	var output bytes.Buffer
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var te common.TestEvent
+		if err := dec.Decode(&te); err != nil {
+			break
+		}
+		key := te.Package + " " + te.Test
+		switch te.Action {
+		case "output":
+			outputHash[key] = append(outputHash[key], te.Output)
+		case "pass":
+			if len(te.Test) > 0 {
+				ts.Passed++
+			}
+			delete(outputHash, key)
+		case "skip":
+			if len(te.Test) > 0 {
+				ts.Skipped++
+			}
+			delete(outputHash, key)
+		case "fail":
+			if len(te.Test) > 0 {
+				ts.Failed++
+			}
+			output.WriteString(strings.Join(outputHash[key], ""))
+			delete(outputHash, key)
+		}
+	}
+	ts.Output = output.String()
+	return ts
+}
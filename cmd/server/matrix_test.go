@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/blackss2/devfarm/common"
+)
+
+func TestExpandMatrix(t *testing.T) {
+	tests := []struct {
+		m    *common.Matrix
+		want []*common.MatrixCell
+	}{
+		{&common.Matrix{}, []*common.MatrixCell{{}}},
+		{
+			&common.Matrix{GoVersions: []string{"1.21", "1.22"}, Platforms: []string{"linux/arm64", "windows"}},
+			[]*common.MatrixCell{
+				{GoVersion: "1.21", GOOS: "linux", GOARCH: "arm64"},
+				{GoVersion: "1.21", GOOS: "windows"},
+				{GoVersion: "1.22", GOOS: "linux", GOARCH: "arm64"},
+				{GoVersion: "1.22", GOOS: "windows"},
+			},
+		},
+		{
+			&common.Matrix{TagSets: []string{"", "netgo,osusergo"}},
+			[]*common.MatrixCell{{}, {Tags: "netgo,osusergo"}},
+		},
+	}
+	for _, tt := range tests {
+		got := expandMatrix(tt.m)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("expandMatrix(%+v) = %+v, want %+v", tt.m, got, tt.want)
+		}
+	}
+}
+
+func TestWithTags(t *testing.T) {
+	tests := []struct {
+		BuildFlags []string
+		Tags       string
+		want       []string
+	}{
+		{[]string{"-v"}, "netgo", []string{"-v", "-tags", "netgo"}},
+		{[]string{"-tags", "a,b", "-v"}, "netgo", []string{"-v", "-tags", "netgo"}},
+		{[]string{"-tags=a", "--tags=b", "-race"}, "c", []string{"-race", "-tags", "c"}},
+		{[]string{"-tags", "a", "-v"}, "", []string{"-v"}},
+		{nil, "", []string{}},
+	}
+	for _, tt := range tests {
+		got := withTags(tt.BuildFlags, tt.Tags)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("withTags(%q, %q) = %q, want %q", tt.BuildFlags, tt.Tags, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blackss2/devfarm/common"
+)
+
+const (
+	gPortEventBuffer = 64
+)
+
+// PortHub keeps the listening ports of a program from the events of the runner
+// and passes the events on to every subscriber.
+type PortHub struct {
+	sync.Mutex
+	portHash map[string]*common.ListenPort
+	subHash  map[chan *common.PortEvent]bool
+	closed   bool
+}
+
+func NewPortHub() *PortHub {
+	ph := &PortHub{
+		portHash: make(map[string]*common.ListenPort),
+		subHash:  make(map[chan *common.PortEvent]bool),
+	}
+	return ph
+}
+
+func (ph *PortHub) Write(bs []byte) (int, error) {
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	for {
+		var pe common.PortEvent
+		err := dec.Decode(&pe)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		ph.publish(&pe)
+	}
+	return len(bs), nil
+}
+
+func (ph *PortHub) publish(pe *common.PortEvent) {
+	ph.Lock()
+	defer ph.Unlock()
+
+	if ph.closed || pe.Port == nil {
+		return
+	}
+	switch pe.Action {
+	case "opened":
+		ph.portHash[pe.Port.String()] = pe.Port
+	case "closed":
+		delete(ph.portHash, pe.Port.String())
+	}
+	for ch := range ph.subHash {
+		select {
+		case ch <- pe:
+		default:
+			// too slow, the events it missed are replaced by a new snapshot
+			ph.resync(ch)
+		}
+	}
+}
+
+func (ph *PortHub) resync(ch chan *common.PortEvent) {
+	for len(ch) > 0 {
+		select {
+		case <-ch:
+		default:
+		}
+	}
+	ch <- ph.snapshot()
+}
+
+func (ph *PortHub) snapshot() *common.PortEvent {
+	return &common.PortEvent{
+		Time:   time.Now(),
+		Action: "snapshot",
+		Ports:  ph.ports(),
+	}
+}
+
+func (ph *PortHub) Ports() []*common.ListenPort {
+	ph.Lock()
+	defer ph.Unlock()
+
+	return ph.ports()
+}
+
+func (ph *PortHub) ports() []*common.ListenPort {
+	ports := make([]*common.ListenPort, 0, len(ph.portHash))
+	for _, lp := range ph.portHash {
+		ports = append(ports, lp)
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].Port != ports[j].Port {
+			return ports[i].Port < ports[j].Port
+		}
+		return ports[i].String() < ports[j].String()
+	})
+	return ports
+}
+
+// Subscribe returns a snapshot of the ports and a channel of the events after it,
+// which is closed with the hub. A subscriber falling behind gets a new snapshot.
+func (ph *PortHub) Subscribe() (*common.PortEvent, chan *common.PortEvent) {
+	ph.Lock()
+	defer ph.Unlock()
+
+	snapshot := ph.snapshot()
+	ch := make(chan *common.PortEvent, gPortEventBuffer)
+	if ph.closed {
+		close(ch)
+	} else {
+		ph.subHash[ch] = true
+	}
+	return snapshot, ch
+}
+
+func (ph *PortHub) Unsubscribe(ch chan *common.PortEvent) {
+	ph.Lock()
+	defer ph.Unlock()
+
+	if ph.subHash[ch] {
+		delete(ph.subHash, ch)
+		close(ch)
+	}
+}
+
+// Wait waits until the program listens on Port.
+func (ph *PortHub) Wait(ctx context.Context, Port int) (*common.ListenPort, error) {
+	snapshot, ch := ph.Subscribe()
+	defer ph.Unsubscribe(ch)
+
+	for _, lp := range snapshot.Ports {
+		if lp.Port == Port {
+			return lp, nil
+		}
+	}
+	for {
+		select {
+		case pe, ok := <-ch:
+			if !ok {
+				return nil, ErrSessionClosed
+			}
+			if pe.Action == "opened" && pe.Port.Port == Port {
+				return pe.Port, nil
+			}
+			for _, lp := range pe.Ports {
+				if lp.Port == Port {
+					return lp, nil
+				}
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (ph *PortHub) Close() {
+	ph.Lock()
+	defer ph.Unlock()
+
+	if ph.closed {
+		return
+	}
+	ph.closed = true
+	for ch := range ph.subHash {
+		close(ch)
+	}
+	ph.subHash = make(map[chan *common.PortEvent]bool)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/blackss2/devfarm/common"
+)
+
+func TestPortHubLag(t *testing.T) {
+	ph := NewPortHub()
+	_, ch := ph.Subscribe()
+	for i := 1; i <= gPortEventBuffer+1; i++ {
+		ph.publish(&common.PortEvent{
+			Action: "opened",
+			Port:   &common.ListenPort{Proto: "tcp", Addr: "0.0.0.0", Port: i},
+		})
+	}
+
+	// the subscriber that fell behind is not taken for a closed session
+	select {
+	case pe, ok := <-ch:
+		if !ok || pe.Action != "snapshot" || len(pe.Ports) != gPortEventBuffer+1 {
+			t.Fatalf("event after the lag = %+v, %v", pe, ok)
+		}
+	default:
+		t.Fatal("no snapshot after the lag")
+	}
+	ph.Unsubscribe(ch)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if lp, err := ph.Wait(ctx, 1); err != nil || lp.Port != 1 {
+		t.Errorf("Wait(1) = %v, %v", lp, err)
+	}
+	if _, err := ph.Wait(ctx, 9999); err != context.DeadlineExceeded {
+		t.Errorf("Wait(9999) = %v, want a timeout", err)
+	}
+
+	ph.Close()
+	if _, err := ph.Wait(context.Background(), 9999); err != ErrSessionClosed {
+		t.Errorf("Wait after Close = %v, want ErrSessionClosed", err)
+	}
+}
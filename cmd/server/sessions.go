@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Sessions keeps the run contexts by session id. A closed session is kept
+// for a while so its client can still read the end of it.
+type Sessions struct {
+	sync.Mutex
+	retention time.Duration
+	rcHash    map[string]*RunContext
+}
+
+func NewSessions(Retention time.Duration) *Sessions {
+	ss := &Sessions{
+		retention: Retention,
+		rcHash:    make(map[string]*RunContext),
+	}
+	return ss
+}
+
+func (ss *Sessions) Add(Id string, rc *RunContext) {
+	ss.Lock()
+	ss.rcHash[Id] = rc
+	ss.Unlock()
+
+	go func() {
+		<-rc.ctx.Done()
+		time.AfterFunc(ss.retention, func() {
+			ss.Remove(Id)
+		})
+	}()
+}
+
+func (ss *Sessions) Get(Id string) (*RunContext, bool) {
+	ss.Lock()
+	defer ss.Unlock()
+
+	rc, has := ss.rcHash[Id]
+	return rc, has
+}
+
+func (ss *Sessions) Remove(Id string) {
+	ss.Lock()
+	defer ss.Unlock()
+
+	delete(ss.rcHash, Id)
+}
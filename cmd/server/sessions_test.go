@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSessionsRetention(t *testing.T) {
+	ss := NewSessions(10 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	rc := NewRunContext(ctx, cancel)
+	ss.Add("a", rc)
+
+	time.Sleep(30 * time.Millisecond)
+	if _, has := ss.Get("a"); !has {
+		t.Fatal("removed an open session")
+	}
+	rc.Close()
+	if _, has := ss.Get("a"); !has {
+		t.Fatal("removed a closed session before the retention")
+	}
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, has := ss.Get("a"); !has {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Error("kept a closed session after the retention")
+}
+
+func TestWatchArtifact(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	rc := NewRunContext(ctx, cancel)
+	rc.Attach()
+	released := false
+	rc.watchArtifact(10*time.Millisecond, func() {
+		released = true
+	})
+	if ctx.Err() == nil {
+		t.Error("kept a build-only session whose artifacts were not fetched")
+	}
+	if !released {
+		t.Error("kept the artifact in the cache")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/blackss2/devfarm/pkg/jobqueue"
+)
+
+type waiter struct {
+	Id   string
+	User string
+}
+
+// SharedJobs joins every session waiting for a build to the job running it,
+// so the job can be followed and cancelled by the id of any of them.
+type SharedJobs struct {
+	sync.Mutex
+	queue      *jobqueue.Queue
+	jobHash    map[string]*jobqueue.Job
+	waiterHash map[string][]waiter
+}
+
+func NewSharedJobs(queue *jobqueue.Queue) *SharedJobs {
+	sj := &SharedJobs{
+		queue:      queue,
+		jobHash:    make(map[string]*jobqueue.Job),
+		waiterHash: make(map[string][]waiter),
+	}
+	return sj
+}
+
+// Wait is called by the session Id before it waits for the build of key.
+func (sj *SharedJobs) Wait(key string, Id string, User string) {
+	sj.Lock()
+	defer sj.Unlock()
+
+	sj.waiterHash[key] = append(sj.waiterHash[key], waiter{Id: Id, User: User})
+	if job, has := sj.jobHash[key]; has {
+		sj.queue.Join(Id, User, job)
+	}
+}
+
+// Leave is called by the session Id once the build of key is over for it.
+func (sj *SharedJobs) Leave(key string, Id string) {
+	sj.Lock()
+	defer sj.Unlock()
+
+	waiters := sj.waiterHash[key]
+	for i, w := range waiters {
+		if w.Id == Id {
+			waiters = append(waiters[:i:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) > 0 {
+		sj.waiterHash[key] = waiters
+	} else {
+		delete(sj.waiterHash, key)
+	}
+}
+
+// Start joins the sessions waiting for key to job, and the ones coming until Finish.
+func (sj *SharedJobs) Start(key string, job *jobqueue.Job) {
+	sj.Lock()
+	defer sj.Unlock()
+
+	sj.jobHash[key] = job
+	for _, w := range sj.waiterHash[key] {
+		sj.queue.Join(w.Id, w.User, job)
+	}
+}
+
+func (sj *SharedJobs) Finish(key string, job *jobqueue.Job) {
+	sj.Lock()
+	defer sj.Unlock()
+
+	if sj.jobHash[key] == job {
+		delete(sj.jobHash, key)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/blackss2/devfarm/pkg/jobqueue"
+)
+
+func TestSharedJobs(t *testing.T) {
+	queue := jobqueue.NewQueue(1, time.Hour)
+	sj := NewSharedJobs(queue)
+
+	gate := make(chan struct{})
+	defer close(gate)
+	sj.Wait("k", "a", "u")
+	sj.Wait("k", "b", "v")
+	job := queue.Submit(context.Background(), "a", "u", func(ctx context.Context) error {
+		<-gate
+		return nil
+	})
+	sj.Start("k", job)
+	sj.Wait("k", "c", "w")
+	sj.Leave("k", "b")
+
+	for _, Id := range []string{"a", "b", "c"} {
+		st, err := queue.Get(Id)
+		if err != nil || (Id != "a" && st.Shared != "a") {
+			t.Errorf("Get(%s) = %+v, %v", Id, st, err)
+		}
+	}
+
+	sj.Finish("k", job)
+	sj.Wait("k", "d", "u")
+	if _, err := queue.Get("d"); err != jobqueue.ErrNotExistJob {
+		t.Errorf("Get(d) after the job = %v", err)
+	}
+}
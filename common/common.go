@@ -2,20 +2,165 @@ package common
 
 import (
 	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
 )
 
 type Manifest struct {
+	User       string   `json:"user"`
 	Command    string   `json:"command"`
 	BuildFlags []string `json:"build_flags"`
 	Packages   string   `json:"packages"`
+	Module     string   `json:"module"`
+	Vendor     bool     `json:"vendor"`
+	Workspace  bool     `json:"workspace"`
+	GoVersion  string   `json:"go_version,omitempty"`
+	GOOS       string   `json:"goos,omitempty"`
+	GOARCH     string   `json:"goarch,omitempty"`
+	CgoEnabled string   `json:"cgo_enabled,omitempty"`
+	BuildOnly  bool     `json:"build_only,omitempty"`
+	Args       []string `json:"args,omitempty"`
+	Env        []string `json:"env,omitempty"`
+
+	PortInterval time.Duration `json:"port_interval,omitempty"`
+	Limits       *RunLimits    `json:"limits,omitempty"`
+
+	SourceDigest string `json:"source_digest"`
+}
+
+type UploadManifest struct {
+	Files map[string]string      `json:"files"`
+	Modes map[string]os.FileMode `json:"modes,omitempty"`
+}
+
+type Matrix struct {
+	GoVersions []string `json:"go_versions"`
+	Platforms  []string `json:"platforms"`
+	TagSets    []string `json:"tag_sets"`
+	Test       bool     `json:"test"`
+}
+
+type MatrixRequest struct {
+	UploadManifest
+	Matrix *Matrix `json:"matrix"`
+}
+
+type MatrixCell struct {
+	GoVersion string `json:"go_version"`
+	GOOS      string `json:"goos"`
+	GOARCH    string `json:"goarch"`
+	Tags      string `json:"tags"`
+}
+
+type MatrixCellResult struct {
+	Cell   *MatrixCell  `json:"cell"`
+	Status string       `json:"status"`
+	Build  *BuildResult `json:"build,omitempty"`
+	Test   *TestSummary `json:"test,omitempty"`
+	Error  string       `json:"error,omitempty"`
+}
+
+type MatrixReport struct {
+	Cells  []*MatrixCellResult `json:"cells"`
+	Passed int                 `json:"passed"`
+	Failed int                 `json:"failed"`
+}
+
+type TestSummary struct {
+	Passed  int    `json:"passed"`
+	Failed  int    `json:"failed"`
+	Skipped int    `json:"skipped"`
+	Output  string `json:"output"`
+	Reason  string `json:"reason,omitempty"`
 }
 
 type SourceFile struct {
 	Path       string
+	Mode       os.FileMode
 	ReadCloser io.ReadCloser
 }
 
 type BinaryFile struct {
 	Path       string
+	Mode       os.FileMode
 	ReadCloser io.ReadCloser
 }
+
+type BuildResult struct {
+	ExitCode    int           `json:"exit_code"`
+	Reason      string        `json:"reason,omitempty"`
+	Duration    time.Duration `json:"duration"`
+	Log         string        `json:"log"`
+	Diagnostics []*Diagnostic `json:"diagnostics"`
+}
+
+type RunResult struct {
+	ExitCode    int            `json:"exit_code"`
+	Signal      string         `json:"signal,omitempty"`
+	Reason      string         `json:"reason,omitempty"`
+	Duration    time.Duration  `json:"duration"`
+	Usage       *ResourceUsage `json:"usage,omitempty"`
+	Error       string         `json:"error,omitempty"`
+	LimitsError string         `json:"limits_error,omitempty"`
+}
+
+type RunLimits struct {
+	MemoryMax int64   `json:"memory_max,omitempty"`
+	CPUs      float64 `json:"cpus,omitempty"`
+	PidsMax   int64   `json:"pids_max,omitempty"`
+	WriteBps  int64   `json:"write_bps,omitempty"`
+}
+
+type ResourceUsage struct {
+	MemoryPeak   int64         `json:"memory_peak"`
+	CPUTime      time.Duration `json:"cpu_time"`
+	CPUThrottled time.Duration `json:"cpu_throttled"`
+	PidsPeak     int64         `json:"pids_peak"`
+	WriteBytes   int64         `json:"write_bytes"`
+}
+
+type ListenPort struct {
+	Proto string `json:"proto"`
+	Addr  string `json:"addr"`
+	Port  int    `json:"port"`
+}
+
+func (lp *ListenPort) String() string {
+	return lp.Proto + " " + net.JoinHostPort(lp.Addr, strconv.Itoa(lp.Port))
+}
+
+type PortEvent struct {
+	Time   time.Time     `json:"time"`
+	Action string        `json:"action"`
+	Port   *ListenPort   `json:"port,omitempty"`
+	Ports  []*ListenPort `json:"ports,omitempty"`
+}
+
+type BuildEvent struct {
+	Time     time.Time    `json:"time"`
+	Action   string       `json:"action"`
+	Phase    string       `json:"phase,omitempty"`
+	Position int          `json:"position,omitempty"`
+	Output   string       `json:"output,omitempty"`
+	Cached   bool         `json:"cached,omitempty"`
+	Result   *BuildResult `json:"result,omitempty"`
+	Error    string       `json:"error,omitempty"`
+}
+
+type Diagnostic struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+type TestEvent struct {
+	Time    time.Time
+	Action  string
+	Package string  `json:",omitempty"`
+	Test    string  `json:",omitempty"`
+	Elapsed float64 `json:",omitempty"`
+	Output  string  `json:",omitempty"`
+}
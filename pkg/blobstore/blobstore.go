@@ -0,0 +1,152 @@
+package blobstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var (
+	ErrInvalidHash  = errors.New("invalid hash")
+	ErrHashMismatch = errors.New("hash mismatch")
+	ErrNotExistBlob = errors.New("not exist blob")
+)
+
+type Store struct {
+	dir string
+}
+
+func NewStore(dir string) (*Store, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	st := &Store{
+		dir: dir,
+	}
+	return st, nil
+}
+
+func (st *Store) Has(hash string) bool {
+	if !IsValidHash(hash) {
+		return false
+	}
+	_, err := os.Stat(st.path(hash))
+	return err == nil
+}
+
+func (st *Store) Missing(hashes []string) []string {
+	missing := make([]string, 0)
+	hashHash := make(map[string]bool)
+	for _, v := range hashes {
+		if hashHash[v] {
+			continue
+		}
+		hashHash[v] = true
+		if !st.Has(v) {
+			missing = append(missing, v)
+		}
+	}
+	return missing
+}
+
+func (st *Store) Put(hash string, r io.Reader) error {
+	if !IsValidHash(hash) {
+		return ErrInvalidHash
+	}
+	if st.Has(hash) {
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	}
+
+	dest := st.path(hash)
+	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(dest), "upload")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, h), r)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != hash {
+		return ErrHashMismatch
+	}
+	return os.Rename(file.Name(), dest)
+}
+
+func (st *Store) Open(hash string) (io.ReadCloser, error) {
+	if !IsValidHash(hash) {
+		return nil, ErrInvalidHash
+	}
+	file, err := os.Open(st.path(hash))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotExistBlob
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+func (st *Store) LazyOpen(hash string) io.ReadCloser {
+	return &lazyReader{
+		st:   st,
+		hash: hash,
+	}
+}
+
+func (st *Store) path(hash string) string {
+	return filepath.Join(st.dir, hash[:2], hash)
+}
+
+func IsValidHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	bs, err := hex.DecodeString(hash)
+	if err != nil {
+		return false
+	}
+	return hex.EncodeToString(bs) == hash
+}
+
+type lazyReader struct {
+	st   *Store
+	hash string
+	rc   io.ReadCloser
+}
+
+func (lr *lazyReader) Read(bs []byte) (int, error) {
+	if lr.rc == nil {
+		rc, err := lr.st.Open(lr.hash)
+		if err != nil {
+			return 0, err
+		}
+		lr.rc = rc
+	}
+	return lr.rc.Read(bs)
+}
+
+func (lr *lazyReader) Close() error {
+	if lr.rc == nil {
+		return nil
+	}
+	return lr.rc.Close()
+}
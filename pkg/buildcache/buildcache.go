@@ -0,0 +1,430 @@
+package buildcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blackss2/devfarm/common"
+)
+
+var (
+	ErrEvicted = errors.New("build is larger than the cache")
+)
+
+type KeySource struct {
+	SourceDigest string   `json:"source_digest"`
+	Command      string   `json:"command"`
+	BuildFlags   []string `json:"build_flags"`
+	Packages     string   `json:"packages"`
+	Module       string   `json:"module"`
+	Vendor       bool     `json:"vendor"`
+	Workspace    bool     `json:"workspace"`
+	GoVersion    string   `json:"go_version"`
+	GOOS         string   `json:"goos"`
+	GOARCH       string   `json:"goarch"`
+	CgoEnabled   string   `json:"cgo_enabled,omitempty"`
+	TrimPath     bool     `json:"trim_path,omitempty"`
+}
+
+func Key(manifest *common.Manifest, SourceDigest string, GoVersion string, GOOS string, GOARCH string, TrimPath bool) (string, error) {
+	if len(manifest.GOOS) > 0 {
+		GOOS = manifest.GOOS
+	}
+	if len(manifest.GOARCH) > 0 {
+		GOARCH = manifest.GOARCH
+	}
+	data, err := json.Marshal(&KeySource{
+		SourceDigest: SourceDigest,
+		Command:      manifest.Command,
+		BuildFlags:   manifest.BuildFlags,
+		Packages:     manifest.Packages,
+		Module:       manifest.Module,
+		Vendor:       manifest.Vendor,
+		Workspace:    manifest.Workspace,
+		GoVersion:    GoVersion,
+		GOOS:         GOOS,
+		GOARCH:       GOARCH,
+		CgoEnabled:   manifest.CgoEnabled,
+		TrimPath:     TrimPath,
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+type call struct {
+	done     chan struct{}
+	cancel   context.CancelFunc
+	waiters  int
+	out      *broadcast
+	path     string
+	err      error
+	finished bool
+}
+
+// broadcast passes what a build writes on to every caller waiting for it,
+// starting with what was written before the caller joined.
+// Each caller is written by its own goroutine, so a slow one doesn't hold back the build.
+type broadcast struct {
+	sync.Mutex
+	history []byte
+	subHash map[io.Writer]*subscriber
+}
+
+type subscriber struct {
+	w      io.Writer
+	sent   int
+	wake   chan struct{}
+	done   chan struct{}
+	closed bool
+	flush  bool
+}
+
+func (b *broadcast) Write(bs []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.history = append(b.history, bs...)
+	for _, sub := range b.subHash {
+		sub.notify()
+	}
+	return len(bs), nil
+}
+
+func (sub *subscriber) notify() {
+	select {
+	case sub.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (b *broadcast) subscribe(w io.Writer) {
+	if w == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	sub := &subscriber{
+		w:    w,
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	b.subHash[w] = sub
+	go b.deliver(sub)
+}
+
+func (b *broadcast) deliver(sub *subscriber) {
+	defer close(sub.done)
+
+	for {
+		b.Lock()
+		// history is only appended, what is taken here stays as it is
+		data := b.history[sub.sent:]
+		closed, flush := sub.closed, sub.flush
+		b.Unlock()
+
+		if closed && !flush {
+			return
+		}
+		if len(data) == 0 {
+			if closed {
+				return
+			}
+			<-sub.wake
+			continue
+		}
+		if _, err := sub.w.Write(data); err != nil {
+			// the caller went away, the build goes on for the others
+			return
+		}
+		sub.sent += len(data)
+	}
+}
+
+// unsubscribe stops writing to w. With flush, it waits until w has got everything written so far.
+func (b *broadcast) unsubscribe(w io.Writer, flush bool) {
+	if w == nil {
+		return
+	}
+	b.Lock()
+	sub, has := b.subHash[w]
+	if !has {
+		b.Unlock()
+		return
+	}
+	delete(b.subHash, w)
+	sub.closed = true
+	sub.flush = flush
+	sub.notify()
+	b.Unlock()
+
+	if flush {
+		<-sub.done
+	}
+}
+
+type entry struct {
+	key      string
+	size     int64
+	lastUsed time.Time
+	inUse    int
+}
+
+// Cache keeps the built zips within maxSize bytes, removing the least recently used ones
+// that no caller holds. The modification time of a zip is its last use.
+type Cache struct {
+	sync.Mutex
+	dir       string
+	maxSize   int64
+	calls     map[string]*call
+	entryHash map[string]*entry
+}
+
+func NewCache(dir string, MaxSize int64) (*Cache, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	bc := &Cache{
+		dir:       dir,
+		maxSize:   MaxSize,
+		calls:     make(map[string]*call),
+		entryHash: make(map[string]*entry),
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if !strings.HasSuffix(info.Name(), ".zip") {
+			// left by a build that didn't finish
+			os.Remove(filepath.Join(dir, info.Name()))
+			continue
+		}
+		key := strings.TrimSuffix(info.Name(), ".zip")
+		bc.entryHash[key] = &entry{
+			key:      key,
+			size:     info.Size(),
+			lastUsed: info.ModTime(),
+		}
+	}
+	bc.Lock()
+	bc.trim()
+	bc.Unlock()
+	return bc, nil
+}
+
+// Lookup returns the zip of key, which is kept until release is called.
+func (bc *Cache) Lookup(key string) (string, func(), bool) {
+	bc.Lock()
+	defer bc.Unlock()
+
+	e, has := bc.entryHash[key]
+	if !has {
+		return "", nil, false
+	}
+	return bc.path(key), bc.acquire(e), true
+}
+
+func (bc *Cache) path(key string) string {
+	return filepath.Join(bc.dir, key+".zip")
+}
+
+func (bc *Cache) acquire(e *entry) func() {
+	e.inUse++
+	bc.touch(e)
+	return bc.releaser(e)
+}
+
+func (bc *Cache) releaser(e *entry) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			bc.Lock()
+			defer bc.Unlock()
+
+			e.inUse--
+			bc.touch(e)
+			bc.trim()
+		})
+	}
+}
+
+func (bc *Cache) touch(e *entry) {
+	e.lastUsed = time.Now()
+	os.Chtimes(bc.path(e.key), e.lastUsed, e.lastUsed)
+}
+
+func (bc *Cache) trim() {
+	if bc.maxSize <= 0 {
+		return
+	}
+	var total int64
+	list := make([]*entry, 0, len(bc.entryHash))
+	for _, e := range bc.entryHash {
+		total += e.size
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].lastUsed.Before(list[j].lastUsed)
+	})
+	for _, e := range list {
+		if total <= bc.maxSize {
+			break
+		}
+		if e.inUse > 0 {
+			continue
+		}
+		total -= e.size
+		os.Remove(bc.path(e.key))
+		delete(bc.entryHash, e.key)
+	}
+}
+
+// Size is the total size of the zips in the cache.
+func (bc *Cache) Size() int64 {
+	bc.Lock()
+	defer bc.Unlock()
+
+	var total int64
+	for _, e := range bc.entryHash {
+		total += e.size
+	}
+	return total
+}
+
+// Do builds the zip of key with build once for all the callers asking for it at the same time.
+// Progress written by build to out reaches the out of every caller, as long as it waits.
+// The zip is kept until release is called.
+func (bc *Cache) Do(ctx context.Context, key string, out io.Writer, build func(ctx context.Context, w io.Writer, out io.Writer) error) (string, func(), bool, error) {
+	path := bc.path(key)
+
+	bc.Lock()
+	if e, has := bc.entryHash[key]; has {
+		release := bc.acquire(e)
+		bc.Unlock()
+		return path, release, true, nil
+	}
+	c, has := bc.calls[key]
+	if !has {
+		buildCtx, cancel := context.WithCancel(context.Background())
+		c = &call{
+			done:   make(chan struct{}),
+			cancel: cancel,
+			out: &broadcast{
+				subHash: make(map[io.Writer]*subscriber),
+			},
+		}
+		bc.calls[key] = c
+		go func() {
+			var size int64
+			c.path, size, c.err = bc.build(buildCtx, path, c.out, build)
+
+			bc.Lock()
+			if bc.calls[key] == c {
+				delete(bc.calls, key)
+			}
+			if c.err == nil {
+				// held for every waiter, each one releases its own
+				e := &entry{
+					key:   key,
+					size:  size,
+					inUse: c.waiters,
+				}
+				bc.entryHash[key] = e
+				bc.touch(e)
+				bc.trim()
+			}
+			c.finished = true
+			bc.Unlock()
+			cancel()
+			close(c.done)
+		}()
+	}
+	c.waiters++
+	bc.Unlock()
+	c.out.subscribe(out)
+
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		bc.Lock()
+		if !c.finished {
+			c.waiters--
+			if c.waiters == 0 {
+				if bc.calls[key] == c {
+					delete(bc.calls, key)
+				}
+				c.cancel()
+			}
+			bc.Unlock()
+			c.out.unsubscribe(out, false)
+			return "", nil, false, ctx.Err()
+		}
+		bc.Unlock()
+	}
+	// the whole output of the build comes before the result
+	c.out.unsubscribe(out, true)
+	return bc.result(c, key, has)
+}
+
+func (bc *Cache) result(c *call, key string, has bool) (string, func(), bool, error) {
+	if c.err != nil {
+		return "", nil, false, c.err
+	}
+	bc.Lock()
+	defer bc.Unlock()
+
+	e, ok := bc.entryHash[key]
+	if !ok {
+		// the zip alone is over the budget and no waiter held it
+		return "", nil, false, ErrEvicted
+	}
+	return c.path, bc.releaser(e), has, nil
+}
+
+func (bc *Cache) build(ctx context.Context, path string, out io.Writer, build func(ctx context.Context, w io.Writer, out io.Writer) error) (string, int64, error) {
+	file, err := ioutil.TempFile(bc.dir, "building")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(file.Name())
+
+	err = build(ctx, file, out)
+	if err != nil {
+		file.Close()
+		return "", 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return "", 0, err
+	}
+	err = file.Close()
+	if err != nil {
+		return "", 0, err
+	}
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		return "", 0, err
+	}
+	return path, info.Size(), nil
+}
@@ -0,0 +1,218 @@
+package buildcache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type syncBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+	written chan struct{}
+	once    sync.Once
+}
+
+func (sb *syncBuffer) Write(bs []byte) (int, error) {
+	sb.Lock()
+	defer sb.Unlock()
+	defer sb.once.Do(func() {
+		close(sb.written)
+	})
+	return sb.Buffer.Write(bs)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.Lock()
+	defer sb.Unlock()
+	return sb.Buffer.String()
+}
+
+func TestDoBroadcast(t *testing.T) {
+	dir, err := ioutil.TempDir("", "devfarm_buildcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bc, err := NewCache(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := &syncBuffer{written: make(chan struct{})}
+	second := &syncBuffer{written: make(chan struct{})}
+	started := make(chan struct{})
+	builds := 0
+	build := func(ctx context.Context, w io.Writer, out io.Writer) error {
+		builds++
+		io.WriteString(out, "compile\n")
+		close(started)
+		// the second caller joins and gets the history
+		<-second.written
+		io.WriteString(out, "package\n")
+		_, err := io.WriteString(w, "zip")
+		return err
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var cached bool
+	go func() {
+		defer wg.Done()
+		_, _, cached, err = bc.Do(context.Background(), "k", first, build)
+	}()
+	<-started
+	path, _, joined, err2 := bc.Do(context.Background(), "k", second, build)
+	wg.Wait()
+	if err != nil || err2 != nil {
+		t.Fatal(err, err2)
+	}
+	if builds != 1 || cached || !joined {
+		t.Errorf("builds = %d, cached = %v, joined = %v", builds, cached, joined)
+	}
+	for _, sb := range []*syncBuffer{first, second} {
+		if got := sb.String(); got != "compile\npackage\n" {
+			t.Errorf("output = %q", got)
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil || string(data) != "zip" {
+		t.Errorf("cached zip = %q, %v", data, err)
+	}
+
+	_, _, cached, err = bc.Do(context.Background(), "k", nil, build)
+	if err != nil || !cached || builds != 1 {
+		t.Errorf("cached = %v, builds = %d, err = %v", cached, builds, err)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "devfarm_buildcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bc, err := NewCache(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	build := func(ctx context.Context, w io.Writer, out io.Writer) error {
+		_, err := io.WriteString(w, "four")
+		return err
+	}
+	do := func(key string) func() {
+		_, release, _, err := bc.Do(context.Background(), key, nil, build)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return release
+	}
+	has := func(key string) bool {
+		_, release, cached := bc.Lookup(key)
+		if cached {
+			release()
+		}
+		return cached
+	}
+
+	do("a")()
+	do("b")()
+	// a is used again, b is the least recently used
+	if !has("a") {
+		t.Fatal("a is not cached")
+	}
+	do("c")()
+	if has("b") {
+		t.Error("b is not evicted")
+	}
+	if bc.Size() != 8 {
+		t.Errorf("size = %d", bc.Size())
+	}
+
+	// entries in use are kept over the budget
+	d := do("d")
+	e := do("e")
+	f := do("f")
+	if bc.Size() != 12 {
+		t.Errorf("size = %d", bc.Size())
+	}
+	d()
+	if bc.Size() != 8 {
+		t.Errorf("size = %d", bc.Size())
+	}
+	e()
+	f()
+
+	// the index is rebuilt from the directory
+	bc2, err := NewCache(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bc2.Size() != bc.Size() {
+		t.Errorf("size = %d, want %d", bc2.Size(), bc.Size())
+	}
+}
+
+type blockWriter struct {
+	release chan struct{}
+	syncBuffer
+}
+
+func (bw *blockWriter) Write(bs []byte) (int, error) {
+	<-bw.release
+	return bw.syncBuffer.Write(bs)
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	dir, err := ioutil.TempDir("", "devfarm_buildcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bc, err := NewCache(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slow := &blockWriter{release: make(chan struct{})}
+	slow.written = make(chan struct{})
+	built := make(chan struct{})
+	build := func(ctx context.Context, w io.Writer, out io.Writer) error {
+		defer close(built)
+		for i := 0; i < 100; i++ {
+			io.WriteString(out, "line\n")
+		}
+		_, err := io.WriteString(w, "zip")
+		return err
+	}
+
+	done := make(chan error)
+	go func() {
+		_, _, _, err := bc.Do(context.Background(), "k", slow, build)
+		done <- err
+	}()
+	select {
+	case <-built:
+	case <-time.After(5 * time.Second):
+		t.Fatal("build is blocked by a slow caller")
+	}
+	select {
+	case <-done:
+		t.Fatal("returned before the output was written")
+	default:
+	}
+	close(slow.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := slow.String(); got != strings.Repeat("line\n", 100) {
+		t.Errorf("output = %q", got)
+	}
+}
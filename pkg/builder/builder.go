@@ -3,6 +3,9 @@ package builder
 import (
 	"archive/zip"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,71 +16,277 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/blackss2/devfarm/common"
+	"github.com/blackss2/devfarm/pkg/sandbox"
 	"github.com/blackss2/devfarm/utils"
 )
 
+type Options struct {
+	GoRoot  string
+	GoCache string
+	// TrimPath builds with -trimpath, which a shared GOCACHE needs to hit across build directories
+	TrimPath bool
+	Sandbox  *sandbox.Config
+	Output   io.Writer
+	Phase    func(Phase string)
+}
+
+const (
+	gWaitDelay = 5 * time.Second
+)
+
+// gSourcePrefixes are the directories a source archive may put files in, besides manifest.json.
+var gSourcePrefixes = []string{"src/", "mod/", "__resources/", "bin/"}
+
 var (
 	ErrNotSupportCommand = errors.New("not support command")
+	ErrNotExistManifest  = errors.New("not exist manifest")
+	ErrCanceled          = errors.New("build canceled")
 )
 
-func BuildFromSourceZip(data []byte) ([]byte, error) {
-	manifest, SourceFiles, err := UnpackSourceZip(data)
+type BuildError struct {
+	Result *common.BuildResult
+}
+
+func (e *BuildError) Error() string {
+	return e.Result.Log
+}
+
+func BuildFromSourceZip(ctx context.Context, r io.ReaderAt, size int64, opts *Options, w io.Writer) (*common.BuildResult, error) {
+	manifest, SourceFiles, err := UnpackSourceZip(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return BuildManifest(ctx, manifest, SourceFiles, opts, w)
+}
+
+func BuildFromSourceFiles(ctx context.Context, SourceFiles []*common.SourceFile, opts *Options, w io.Writer) (*common.BuildResult, error) {
+	manifest, SourceFiles, err := UnpackSourceFiles(SourceFiles)
 	if err != nil {
 		return nil, err
 	}
+	return BuildManifest(ctx, manifest, SourceFiles, opts, w)
+}
+
+func BuildManifest(ctx context.Context, manifest *common.Manifest, SourceFiles []*common.SourceFile, opts *Options, w io.Writer) (*common.BuildResult, error) {
 	if manifest.Command != "install" && manifest.Command != "build" {
 		return nil, ErrNotSupportCommand
 	}
 
-	binary, err := Build(manifest, SourceFiles)
+	result, err := Build(ctx, manifest, SourceFiles, opts, w)
 	if err != nil {
-		return nil, err
+		return result, err
 	}
-	return binary, nil
+	return result, nil
 }
 
-func UnpackSourceZip(data []byte) (*common.Manifest, []*common.SourceFile, error) {
-	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+func UnpackSourceZip(r io.ReaderAt, size int64) (*common.Manifest, []*common.SourceFile, error) {
+	zr, err := zip.NewReader(r, size)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	var manifest common.Manifest
-	SourceFiles := make([]*common.SourceFile, 0, len(zr.File)-1)
+	SourceFiles := make([]*common.SourceFile, 0, len(zr.File))
 	for _, file := range zr.File {
-		if file.Name == "manifest.json" {
-			fr, err := file.Open()
-			if err != nil {
-				return nil, nil, err
-			}
-			err = json.NewDecoder(fr).Decode(&manifest)
+		fr, err := file.Open()
+		if err != nil {
+			return nil, nil, err
+		}
+		sf := &common.SourceFile{
+			Path:       file.Name,
+			Mode:       file.Mode(),
+			ReadCloser: fr,
+		}
+		SourceFiles = append(SourceFiles, sf)
+	}
+	return UnpackSourceFiles(SourceFiles)
+}
+
+func UnpackSourceFiles(Files []*common.SourceFile) (*common.Manifest, []*common.SourceFile, error) {
+	var manifest common.Manifest
+	hasManifest := false
+	SourceFiles := make([]*common.SourceFile, 0, len(Files))
+	for _, sf := range Files {
+		if sf.Path == "manifest.json" {
+			err := json.NewDecoder(sf.ReadCloser).Decode(&manifest)
+			sf.ReadCloser.Close()
 			if err != nil {
 				return nil, nil, err
 			}
+			hasManifest = true
 		} else {
-			fr, err := file.Open()
+			Path, err := utils.CleanArchivePath(sf.Path, gSourcePrefixes...)
 			if err != nil {
 				return nil, nil, err
 			}
-			sf := &common.SourceFile{
-				Path:       file.Name,
-				ReadCloser: fr,
-			}
+			sf.Path = Path
 			SourceFiles = append(SourceFiles, sf)
 		}
 	}
+	if !hasManifest {
+		return nil, nil, ErrNotExistManifest
+	}
 	return &manifest, SourceFiles, nil
 }
 
-func Build(manifest *common.Manifest, SourceFiles []*common.SourceFile) ([]byte, error) {
-	tempDir, err := ioutil.TempDir("", "devfarm_builder")
+func DigestSourceZip(r io.ReaderAt, size int64) (string, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return "", err
+	}
+
+	files := make(map[string]string)
+	modes := make(map[string]os.FileMode)
+	for _, file := range zr.File {
+		if file.Name == "manifest.json" {
+			continue
+		}
+		fr, err := file.Open()
+		if err != nil {
+			return "", err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, fr)
+		fr.Close()
+		if err != nil {
+			return "", err
+		}
+		files[file.Name] = hex.EncodeToString(h.Sum(nil))
+		modes[file.Name] = file.Mode()
+	}
+	return utils.DigestFiles(files, modes), nil
+}
+
+func GoBin() string {
+	return filepath.Clean(fmt.Sprintf(`%s%s`, os.Getenv("GOROOT"), `/bin/go`))
+}
+
+func GoPlatform() (string, string, error) {
+	out, err := exec.Command(GoBin(), "env", "GOOS", "GOARCH").Output()
+	if err != nil {
+		return "", "", err
+	}
+	lines := strings.Fields(string(out))
+	if len(lines) != 2 {
+		return "", "", errors.New("unexpected go env output: " + string(out))
+	}
+	return lines[0], lines[1], nil
+}
+
+func Build(ctx context.Context, manifest *common.Manifest, SourceFiles []*common.SourceFile, opts *Options, w io.Writer) (*common.BuildResult, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	opts.phase("unpack")
+	tempDir, err := prepareWorkDir(SourceFiles)
 	if err != nil {
 		return nil, err
 	}
 	defer os.RemoveAll(tempDir)
 
+	sb, ctx, err := startSandbox(ctx, opts, tempDir)
+	if err != nil {
+		return nil, err
+	}
+	if sb != nil {
+		defer sb.Close()
+	}
+
+	Args := []string{manifest.Command}
+	Args = append(Args, manifest.BuildFlags...)
+	if opts.TrimPath && !hasFlag(manifest.BuildFlags, "-trimpath") {
+		Args = append(Args, "-trimpath")
+	}
+	if manifest.Command == "build" {
+		Args = append(Args, "-o", tempDir+"/bin/")
+	}
+	Args = append(Args, manifest.Packages)
+
+	cmd := goCommand(ctx, manifest, opts, tempDir, Args)
+	err = applySandbox(sb, cmd, opts, tempDir)
+	if err != nil {
+		return nil, err
+	}
+	setProcessGroup(cmd)
+	rewrite := func(File string) string {
+		return archivePath(tempDir, cmd.Dir, File)
+	}
+
+	var output bytes.Buffer
+	var out io.Writer = &output
+	var lw *lineWriter
+	if opts.Output != nil {
+		lw = &lineWriter{w: opts.Output, rewrite: rewrite}
+		out = io.MultiWriter(&output, lw)
+	}
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	opts.phase("compile")
+	start := time.Now()
+	err = cmd.Run()
+	if lw != nil {
+		lw.Flush()
+	}
+
+	result := &common.BuildResult{
+		Duration: time.Since(start),
+	}
+	result.Log, result.Diagnostics = utils.RewriteDiagnostics(output.String(), rewrite)
+	if sb != nil {
+		if verr := sb.Violation(); verr != nil {
+			result.ExitCode = -1
+			result.Reason = verr.Error()
+			return result, &BuildError{Result: result}
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, ErrCanceled
+	}
+	if err != nil {
+		ee, ok := err.(*exec.ExitError)
+		if !ok {
+			return nil, err
+		}
+		result.ExitCode = ee.ExitCode()
+		return result, &BuildError{Result: result}
+	}
+
+	opts.phase("package")
+	zw := zip.NewWriter(w)
+	err = utils.AddDirToZip(zw, fmt.Sprintf(`%s/bin/`, tempDir), "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range SourceFiles {
+		err := func(sf *common.SourceFile) error {
+			if !strings.HasPrefix(sf.Path, "src/") && !strings.HasPrefix(sf.Path, "mod/") {
+				defer sf.ReadCloser.Close()
+				return utils.CopyToZip(zw, sf.Path, sf.Mode, sf.ReadCloser)
+			}
+			return nil
+		}(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func prepareWorkDir(SourceFiles []*common.SourceFile) (string, error) {
+	tempDir, err := ioutil.TempDir("", "devfarm_builder")
+	if err != nil {
+		return "", err
+	}
+
 	dirPaths := make([]string, 0, len(SourceFiles))
 	for _, sf := range SourceFiles {
 		dir := filepath.Dir(sf.Path)
@@ -94,95 +303,214 @@ func Build(manifest *common.Manifest, SourceFiles []*common.SourceFile) ([]byte,
 	}
 	for i, v := range dirPaths {
 		if !nodeMarker[i] {
-			err := os.MkdirAll(fmt.Sprintf(`%s/%s`, tempDir, v), os.ModeDir)
+			err := os.MkdirAll(fmt.Sprintf(`%s/%s`, tempDir, v), os.ModeDir|0755)
 			if err != nil {
-				return nil, err
+				os.RemoveAll(tempDir)
+				return "", err
 			}
 		}
 	}
 
+	names := make([]string, 0, len(SourceFiles))
 	for _, v := range SourceFiles {
 		err := func(sf *common.SourceFile) error {
-			if strings.HasPrefix(sf.Path, "src/") {
-				file, err := os.Create(fmt.Sprintf(`%s/%s`, tempDir, sf.Path))
-				if err != nil {
-					return err
-				}
-				defer file.Close()
-				_, err = io.Copy(file, sf.ReadCloser)
-				if err != nil {
-					return err
-				}
+			if strings.HasPrefix(sf.Path, "src/") || strings.HasPrefix(sf.Path, "mod/") {
+				defer sf.ReadCloser.Close()
+				names = append(names, sf.Path)
+				return utils.WriteZipEntry(tempDir, sf.Path, sf.Mode, sf.ReadCloser)
 			}
 			return nil
 		}(v)
 		if err != nil {
-			return nil, err
+			os.RemoveAll(tempDir)
+			return "", err
 		}
 	}
+	err = utils.CheckSymlinks(tempDir, names)
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return "", err
+	}
+	return tempDir, nil
+}
 
-	gobin := filepath.Clean(fmt.Sprintf(`%s%s`, os.Getenv("GOROOT"), `/bin/go`))
-	Args := []string{manifest.Command}
-	Args = append(Args, manifest.BuildFlags...)
-	Args = append(Args, manifest.Packages)
+func goCommand(ctx context.Context, manifest *common.Manifest, opts *Options, tempDir string, Args []string) *exec.Cmd {
+	goBin := GoBin()
+	buildEnvs := []string{
+		"GOPATH=" + tempDir,
+	}
+	if len(opts.GoRoot) > 0 {
+		goBin = filepath.Join(opts.GoRoot, "bin", "go")
+		buildEnvs = append(buildEnvs, "GOROOT="+opts.GoRoot)
+	}
 
-	cmd := exec.Command(gobin, Args...)
+	cmd := exec.CommandContext(ctx, goBin, Args...)
 	cmd.Dir = tempDir
 
-	envs := make([]string, 0)
-	for _, v := range os.Environ() {
-		if strings.HasPrefix(v, "GOPATH=") {
-			envs = append(envs, "GOPATH="+tempDir)
+	if len(manifest.GOOS) > 0 || len(manifest.GOARCH) > 0 {
+		// go install puts cross-compiled binaries in bin/GOOS_GOARCH and refuses GOBIN
+		buildEnvs = append(buildEnvs, "GOBIN=")
+		if len(manifest.GOOS) > 0 {
+			buildEnvs = append(buildEnvs, "GOOS="+manifest.GOOS)
+		}
+		if len(manifest.GOARCH) > 0 {
+			buildEnvs = append(buildEnvs, "GOARCH="+manifest.GOARCH)
+		}
+	} else {
+		buildEnvs = append(buildEnvs, "GOBIN="+tempDir+"/bin")
+	}
+	if len(manifest.CgoEnabled) > 0 {
+		buildEnvs = append(buildEnvs, "CGO_ENABLED="+manifest.CgoEnabled)
+	}
+	if len(opts.GoCache) > 0 {
+		buildEnvs = append(buildEnvs, "GOCACHE="+opts.GoCache)
+	}
+	if len(manifest.Module) > 0 {
+		cmd.Dir = filepath.Join(tempDir, "src", filepath.FromSlash(manifest.Module))
+
+		buildEnvs = append(buildEnvs,
+			"GO111MODULE=on",
+			"GOMODCACHE="+tempDir+"/pkg/mod",
+			"GOPROXY=file://"+filepath.ToSlash(tempDir)+"/mod",
+			"GOSUMDB=off",
+			"GOTOOLCHAIN=local",
+		)
+		if manifest.Vendor {
+			buildEnvs = append(buildEnvs, "GOFLAGS="+mergeGoFlags(os.Getenv("GOFLAGS"), "-modcacherw", "-mod=vendor"))
+		} else {
+			buildEnvs = append(buildEnvs, "GOFLAGS="+mergeGoFlags(os.Getenv("GOFLAGS"), "-modcacherw"))
+		}
+		if manifest.Workspace {
+			buildEnvs = append(buildEnvs, "GOWORK="+tempDir+"/src/go.work")
 		} else {
+			buildEnvs = append(buildEnvs, "GOWORK=off")
+		}
+	} else {
+		buildEnvs = append(buildEnvs, "GO111MODULE=off")
+	}
+
+	baseEnvs := os.Environ()
+	if opts.Sandbox != nil {
+		baseEnvs = sandbox.Env(tempDir)
+	}
+	envs := make([]string, 0)
+	for _, v := range baseEnvs {
+		if !hasEnvKey(buildEnvs, v) {
 			envs = append(envs, v)
 		}
 	}
+	envs = append(envs, buildEnvs...)
 	cmd.Env = envs
+	return cmd
+}
 
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stdin = os.Stdin
-	cmd.Stderr = &stderr
-	err = cmd.Run()
+func startSandbox(ctx context.Context, opts *Options, tempDir string) (*sandbox.Sandbox, context.Context, error) {
+	if opts.Sandbox == nil {
+		return nil, ctx, nil
+	}
+	err := os.MkdirAll(filepath.Join(tempDir, "tmp"), 0755)
 	if err != nil {
-		if !strings.Contains(err.Error(), "exit status") {
-			return nil, err
+		return nil, nil, err
+	}
+	Owner := tempDir
+	if len(opts.GoCache) > 0 {
+		Owner = opts.GoCache
+	}
+	return sandbox.New(ctx, opts.Sandbox, filepath.Base(tempDir), Owner)
+}
+
+func applySandbox(sb *sandbox.Sandbox, cmd *exec.Cmd, opts *Options, tempDir string) error {
+	if sb == nil {
+		return nil
+	}
+	Dirs := []string{tempDir}
+	if len(opts.GoCache) > 0 {
+		Dirs = append(Dirs, opts.GoCache)
+	}
+	return sb.Apply(cmd, Dirs...)
+}
+
+func (opts *Options) phase(Phase string) {
+	if opts.Phase != nil {
+		opts.Phase(Phase)
+	}
+}
+
+type lineWriter struct {
+	w       io.Writer
+	rewrite func(File string) string
+	buffer  []byte
+}
+
+func (lw *lineWriter) Write(bs []byte) (int, error) {
+	lw.buffer = append(lw.buffer, bs...)
+	for {
+		idx := bytes.IndexByte(lw.buffer, '\n')
+		if idx < 0 {
+			break
 		}
+		line, _ := utils.RewriteDiagnostics(string(lw.buffer[:idx+1]), lw.rewrite)
+		lw.buffer = lw.buffer[idx+1:]
+		lw.w.Write([]byte(line))
+	}
+	return len(bs), nil
+}
+
+func (lw *lineWriter) Flush() {
+	if len(lw.buffer) > 0 {
+		line, _ := utils.RewriteDiagnostics(string(lw.buffer), lw.rewrite)
+		lw.buffer = nil
+		lw.w.Write([]byte(line))
+	}
+}
+
+func archivePath(tempDir string, dir string, File string) string {
+	path := File
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	rel, err := filepath.Rel(tempDir, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return File
 	}
+	return filepath.ToSlash(rel)
+}
 
-	msg := stderr.String() + stdout.String()
-	if len(msg) > 0 {
-		if strings.Contains(msg, ":") {
-			return nil, errors.New(msg)
+func hasFlag(BuildFlags []string, flag string) bool {
+	for _, v := range BuildFlags {
+		if v == flag || strings.HasPrefix(v, flag+"=") {
+			return true
 		}
 	}
+	return false
+}
 
-	var buffer bytes.Buffer
-	zw := zip.NewWriter(&buffer)
-	err = utils.AddDirToZip(zw, fmt.Sprintf(`%s/bin/`, tempDir), "", nil)
-	if err != nil {
-		return nil, err
+// mergeGoFlags appends flags to GoFlags, dropping the ones of GoFlags with the same name
+// so that the flags the build depends on win.
+func mergeGoFlags(GoFlags string, flags ...string) string {
+	merged := make([]string, 0)
+	for _, v := range strings.Fields(GoFlags) {
+		name := v
+		if idx := strings.Index(v, "="); idx >= 0 {
+			name = v[:idx]
+		}
+		if !hasFlag(flags, name) {
+			merged = append(merged, v)
+		}
 	}
+	return strings.Join(append(merged, flags...), " ")
+}
 
-	for _, v := range SourceFiles {
-		err := func(sf *common.SourceFile) error {
-			if !strings.HasPrefix(sf.Path, "src/") {
-				fw, err := zw.Create(sf.Path)
-				if err != nil {
-					return err
-				}
-				_, err = io.Copy(fw, sf.ReadCloser)
-				if err != nil {
-					return err
-				}
-			}
-			return nil
-		}(v)
-		if err != nil {
-			return nil, err
+func hasEnvKey(envs []string, env string) bool {
+	idx := strings.Index(env, "=")
+	if idx < 0 {
+		return false
+	}
+	key := env[:idx+1]
+	for _, v := range envs {
+		if strings.HasPrefix(v, key) {
+			return true
 		}
 	}
-	zw.Close()
-	return buffer.Bytes(), nil
+	return false
 }
@@ -0,0 +1,81 @@
+package builder
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/blackss2/devfarm/common"
+)
+
+func sourceFile(Path string, data string) *common.SourceFile {
+	return &common.SourceFile{
+		Path:       Path,
+		Mode:       0644,
+		ReadCloser: ioutil.NopCloser(strings.NewReader(data)),
+	}
+}
+
+func TestUnpackSourceFiles(t *testing.T) {
+	manifest, SourceFiles, err := UnpackSourceFiles([]*common.SourceFile{
+		sourceFile("manifest.json", `{"Command":"build","Packages":"example.com/x"}`),
+		sourceFile("src/example.com/x/./main.go", "package main"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Command != "build" || len(SourceFiles) != 1 || SourceFiles[0].Path != "src/example.com/x/main.go" {
+		t.Fatalf("unexpected unpack: %+v %+v", manifest, SourceFiles)
+	}
+
+	for _, Path := range []string{"src/../../../etc/cron.d/x", "/etc/cron.d/x", "etc/cron.d/x"} {
+		_, _, err := UnpackSourceFiles([]*common.SourceFile{
+			sourceFile("manifest.json", `{"Command":"build"}`),
+			sourceFile(Path, "x"),
+		})
+		if err == nil {
+			t.Errorf("UnpackSourceFiles accepted %q", Path)
+		}
+	}
+}
+
+func TestMergeGoFlags(t *testing.T) {
+	tests := []struct {
+		GoFlags string
+		flags   []string
+		want    string
+	}{
+		{"", []string{"-modcacherw"}, "-modcacherw"},
+		{"-tags=foo", []string{"-modcacherw"}, "-tags=foo -modcacherw"},
+		{"-mod=mod -tags=foo", []string{"-modcacherw", "-mod=vendor"}, "-tags=foo -modcacherw -mod=vendor"},
+		{"  -modcacherw   -v ", []string{"-modcacherw"}, "-v -modcacherw"},
+	}
+	for _, tt := range tests {
+		got := mergeGoFlags(tt.GoFlags, tt.flags...)
+		if got != tt.want {
+			t.Errorf("mergeGoFlags(%q, %q) = %q, want %q", tt.GoFlags, tt.flags, got, tt.want)
+		}
+	}
+}
+
+func TestCheckTestEnv(t *testing.T) {
+	tests := []struct {
+		Env []string
+		ok  bool
+	}{
+		{nil, true},
+		{[]string{"PORT=8080", "DB_URL=postgres://x", "GOPHER=1x"}, false},
+		{[]string{"PORT=8080", "DB_URL=postgres://x"}, true},
+		{[]string{"GOFLAGS=-mod=mod"}, false},
+		{[]string{"CGO_ENABLED=1"}, false},
+		{[]string{"CC=clang"}, false},
+		{[]string{"PATH=/tmp"}, false},
+		{[]string{"CCACHE=1", "HOMEPAGE=x"}, true},
+	}
+	for _, tt := range tests {
+		err := CheckTestEnv(tt.Env)
+		if (err == nil) != tt.ok {
+			t.Errorf("CheckTestEnv(%q) = %v", tt.Env, err)
+		}
+	}
+}
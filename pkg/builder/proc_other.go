@@ -0,0 +1,11 @@
+//go:build !unix
+
+package builder
+
+import (
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.WaitDelay = gWaitDelay
+}
@@ -0,0 +1,193 @@
+package builder
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blackss2/devfarm/common"
+)
+
+var (
+	ErrTestFailed  = errors.New("test failed")
+	ErrReservedEnv = errors.New("environment variable of the go command")
+)
+
+var (
+	// the go command reads these besides GO* and CGO_*; the sandbox sets PATH, HOME and TMPDIR
+	gToolEnvKeys = []string{"CC", "CXX", "FC", "AR", "PKG_CONFIG", "GCCGO", "PATH", "HOME", "TMPDIR"}
+)
+
+func TestFromSourceZip(ctx context.Context, r io.ReaderAt, size int64, opts *Options, w io.Writer) error {
+	manifest, SourceFiles, err := UnpackSourceZip(r, size)
+	if err != nil {
+		return err
+	}
+	return TestManifest(ctx, manifest, SourceFiles, opts, w)
+}
+
+// CheckTestEnv rejects the variables that would change how the go command builds the tests, not only the test binary.
+func CheckTestEnv(Env []string) error {
+	for _, v := range Env {
+		key := v
+		if idx := strings.Index(v, "="); idx >= 0 {
+			key = v[:idx]
+		}
+		if strings.HasPrefix(key, "GO") || strings.HasPrefix(key, "CGO_") {
+			return fmt.Errorf("%v: %s", ErrReservedEnv, key)
+		}
+		for _, k := range gToolEnvKeys {
+			if key == k {
+				return fmt.Errorf("%v: %s", ErrReservedEnv, key)
+			}
+		}
+	}
+	return nil
+}
+
+func TestManifest(ctx context.Context, manifest *common.Manifest, SourceFiles []*common.SourceFile, opts *Options, w io.Writer) error {
+	if manifest.Command != "test" {
+		return ErrNotSupportCommand
+	}
+	if opts == nil {
+		opts = &Options{}
+	}
+	err := CheckTestEnv(manifest.Env)
+	if err != nil {
+		return err
+	}
+
+	tempDir, err := prepareWorkDir(SourceFiles)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	sb, ctx, err := startSandbox(ctx, opts, tempDir)
+	if err != nil {
+		return err
+	}
+	if sb != nil {
+		defer sb.Close()
+	}
+
+	Args := []string{"test", "-json"}
+	Args = append(Args, manifest.BuildFlags...)
+	if opts.TrimPath && !hasFlag(manifest.BuildFlags, "-trimpath") {
+		Args = append(Args, "-trimpath")
+	}
+	Args = append(Args, manifest.Packages)
+	if len(manifest.Args) > 0 {
+		Args = append(Args, "-args")
+		Args = append(Args, manifest.Args...)
+	}
+
+	cmd := goCommand(ctx, manifest, opts, tempDir, Args)
+	cmd.Env = append(cmd.Env, manifest.Env...)
+	err = applySandbox(sb, cmd, opts, tempDir)
+	if err != nil {
+		return err
+	}
+	setProcessGroup(cmd)
+
+	ew := &eventWriter{w: w}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ErrCanceled
+		}
+		return err
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			var te common.TestEvent
+			if err := json.Unmarshal(line, &te); err != nil {
+				ew.Output(string(line) + "\n")
+				continue
+			}
+			ew.Write(&te)
+		}
+		// a line over the buffer stops the scanner, the test must not block on a full pipe
+		io.Copy(ioutil.Discard, stdout)
+	}()
+	go func() {
+		defer wg.Done()
+		scanner := bufio.NewScanner(stderr)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			ew.Output(scanner.Text() + "\n")
+		}
+		io.Copy(ioutil.Discard, stderr)
+	}()
+	wg.Wait()
+
+	err = cmd.Wait()
+	if sb != nil {
+		if verr := sb.Violation(); verr != nil {
+			ew.Output(verr.Error() + "\n")
+			return verr
+		}
+	}
+	if ctx.Err() != nil {
+		return ErrCanceled
+	}
+	if err != nil {
+		if !strings.Contains(err.Error(), "exit status") {
+			return err
+		}
+		return ErrTestFailed
+	}
+	return ew.err
+}
+
+type eventWriter struct {
+	sync.Mutex
+	w   io.Writer
+	err error
+}
+
+func (ew *eventWriter) Write(te *common.TestEvent) {
+	data, err := json.Marshal(te)
+	if err != nil {
+		return
+	}
+
+	ew.Lock()
+	defer ew.Unlock()
+	if ew.err != nil {
+		return
+	}
+	_, ew.err = ew.w.Write(append(data, '\n'))
+}
+
+func (ew *eventWriter) Output(Output string) {
+	ew.Write(&common.TestEvent{
+		Time:   time.Now(),
+		Action: "output",
+		Output: Output,
+	})
+}
@@ -0,0 +1,257 @@
+package gocache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotExistCache = errors.New("not exist cache")
+	ErrCacheInUse    = errors.New("cache in use")
+)
+
+type Stat struct {
+	Id       string    `json:"id"`
+	Tenant   string    `json:"tenant"`
+	Project  string    `json:"project"`
+	Size     int64     `json:"size"`
+	Files    int       `json:"files"`
+	Builds   int       `json:"builds"`
+	Evicted  int64     `json:"evicted"`
+	LastUsed time.Time `json:"last_used"`
+	InUse    int       `json:"in_use"`
+}
+
+type Manager struct {
+	sync.Mutex
+	dir          string
+	maxSize      int64
+	maxTotalSize int64
+	statHash     map[string]*Stat
+}
+
+func NewManager(dir string, MaxSize int64, MaxTotalSize int64) (*Manager, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	gm := &Manager{
+		dir:          dir,
+		maxSize:      MaxSize,
+		maxTotalSize: MaxTotalSize,
+		statHash:     make(map[string]*Stat),
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, info.Name(), "info.json"))
+		if err != nil {
+			continue
+		}
+		var st Stat
+		if err := json.Unmarshal(data, &st); err != nil {
+			continue
+		}
+		st.Id = info.Name()
+		st.InUse = 0
+		st.Size, st.Files = dirSize(gm.cacheDir(st.Id))
+		gm.statHash[st.Id] = &st
+	}
+	return gm, nil
+}
+
+func CacheId(Tenant string, Project string) string {
+	sum := sha256.Sum256([]byte(Tenant + "\x00" + Project))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (gm *Manager) Acquire(Tenant string, Project string) (string, func(), error) {
+	Id := CacheId(Tenant, Project)
+
+	gm.Lock()
+	defer gm.Unlock()
+
+	st, has := gm.statHash[Id]
+	if !has {
+		st = &Stat{
+			Id:      Id,
+			Tenant:  Tenant,
+			Project: Project,
+		}
+		gm.statHash[Id] = st
+	}
+	dir := gm.cacheDir(Id)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", nil, err
+	}
+	st.InUse++
+	st.Builds++
+	st.LastUsed = time.Now()
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			gm.release(st)
+		})
+	}
+	return dir, release, nil
+}
+
+func (gm *Manager) release(st *Stat) {
+	gm.Lock()
+	defer gm.Unlock()
+
+	st.InUse--
+	st.LastUsed = time.Now()
+	if st.InUse == 0 {
+		st.Size, st.Files = dirSize(gm.cacheDir(st.Id))
+		if gm.maxSize > 0 && st.Size > gm.maxSize {
+			evicted := trimDir(gm.cacheDir(st.Id), gm.maxSize*8/10)
+			st.Evicted += evicted
+			st.Size, st.Files = dirSize(gm.cacheDir(st.Id))
+		}
+	}
+	gm.writeInfo(st)
+	gm.trimTotal()
+}
+
+func (gm *Manager) trimTotal() {
+	if gm.maxTotalSize <= 0 {
+		return
+	}
+	var total int64
+	list := make([]*Stat, 0, len(gm.statHash))
+	for _, st := range gm.statHash {
+		total += st.Size
+		list = append(list, st)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LastUsed.Before(list[j].LastUsed)
+	})
+	for _, st := range list {
+		if total <= gm.maxTotalSize {
+			break
+		}
+		if st.InUse > 0 {
+			continue
+		}
+		total -= st.Size
+		gm.remove(st)
+	}
+}
+
+func (gm *Manager) Stats() []*Stat {
+	gm.Lock()
+	defer gm.Unlock()
+
+	list := make([]*Stat, 0, len(gm.statHash))
+	for _, st := range gm.statHash {
+		cp := *st
+		list = append(list, &cp)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LastUsed.After(list[j].LastUsed)
+	})
+	return list
+}
+
+func (gm *Manager) Clear(Id string) error {
+	gm.Lock()
+	defer gm.Unlock()
+
+	st, has := gm.statHash[Id]
+	if !has {
+		return ErrNotExistCache
+	}
+	if st.InUse > 0 {
+		return ErrCacheInUse
+	}
+	gm.remove(st)
+	return nil
+}
+
+func (gm *Manager) remove(st *Stat) {
+	os.RemoveAll(filepath.Join(gm.dir, st.Id))
+	delete(gm.statHash, st.Id)
+}
+
+func (gm *Manager) cacheDir(Id string) string {
+	return filepath.Join(gm.dir, Id, "cache")
+}
+
+func (gm *Manager) writeInfo(st *Stat) {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return
+	}
+	ioutil.WriteFile(filepath.Join(gm.dir, st.Id, "info.json"), data, 0600)
+}
+
+type cacheFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func dirSize(dir string) (int64, int) {
+	var size int64
+	var count int
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+			count++
+		}
+		return nil
+	})
+	return size, count
+}
+
+func trimDir(dir string, limit int64) int64 {
+	files := make([]*cacheFile, 0)
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		if filepath.Dir(path) == dir {
+			return nil
+		}
+		size += info.Size()
+		files = append(files, &cacheFile{
+			path:    path,
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	var evicted int64
+	for _, f := range files {
+		if size <= limit {
+			break
+		}
+		if err := os.Remove(f.path); err == nil {
+			size -= f.size
+			evicted += f.size
+		}
+	}
+	return evicted
+}
@@ -0,0 +1,363 @@
+package jobqueue
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotExistJob = errors.New("not exist job")
+	ErrJobFinished = errors.New("job finished")
+)
+
+const (
+	StateQueued    = "queued"
+	StateBuilding  = "building"
+	StateSucceeded = "succeeded"
+	StateFailed    = "failed"
+	StateCancelled = "cancelled"
+)
+
+type Status struct {
+	Id         string    `json:"id"`
+	User       string    `json:"user"`
+	State      string    `json:"state"`
+	Position   int       `json:"position,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Shared     string    `json:"shared,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+type Job struct {
+	status Status
+	run    func(ctx context.Context) error
+	err    error
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (j *Job) Id() string {
+	return j.status.Id
+}
+
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// Err is the error of the finished job, context.Canceled if it was cancelled.
+func (j *Job) Err() error {
+	<-j.done
+	return j.err
+}
+
+// session waits for a job it didn't submit, or for its own job it has left to the others.
+type session struct {
+	job        *Job
+	user       string
+	createdAt  time.Time
+	detachedAt time.Time
+}
+
+// Queue runs jobs on a fixed number of workers, taking the next job
+// from each user in turn so that one user can't starve the others.
+type Queue struct {
+	sync.Mutex
+	cond        *sync.Cond
+	retention   time.Duration
+	jobHash     map[string]*Job
+	sessionHash map[string]*session
+	pending     map[string][]*Job
+	users       []string
+}
+
+func NewQueue(Workers int, Retention time.Duration) *Queue {
+	if Workers < 1 {
+		Workers = 1
+	}
+	q := &Queue{
+		retention:   Retention,
+		jobHash:     make(map[string]*Job),
+		sessionHash: make(map[string]*session),
+		pending:     make(map[string][]*Job),
+	}
+	q.cond = sync.NewCond(&q.Mutex)
+	for i := 0; i < Workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+func (q *Queue) Submit(ctx context.Context, Id string, User string, run func(ctx context.Context) error) *Job {
+	ctx, cancel := context.WithCancel(ctx)
+	j := &Job{
+		status: Status{
+			Id:        Id,
+			User:      User,
+			State:     StateQueued,
+			CreatedAt: time.Now(),
+		},
+		run:    run,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	q.Lock()
+	q.prune()
+	q.jobHash[Id] = j
+	if _, has := q.pending[User]; !has {
+		q.users = append(q.users, User)
+	}
+	q.pending[User] = append(q.pending[User], j)
+	q.Unlock()
+	q.cond.Signal()
+
+	go func() {
+		<-ctx.Done()
+		q.dequeue(j)
+	}()
+	return j
+}
+
+func (q *Queue) Run(ctx context.Context, Id string, User string, run func(ctx context.Context) error) error {
+	return q.Submit(ctx, Id, User, run).Err()
+}
+
+// Join makes the session Id wait for j, Get of Id follows j until the session is detached.
+func (q *Queue) Join(Id string, User string, j *Job) {
+	q.Lock()
+	defer q.Unlock()
+
+	if Id == j.status.Id {
+		return
+	}
+	q.sessionHash[Id] = &session{
+		job:       j,
+		user:      User,
+		createdAt: time.Now(),
+	}
+}
+
+// Detach cancels the session Id alone, its job goes on for the other sessions waiting for it.
+func (q *Queue) Detach(Id string) error {
+	q.Lock()
+	defer q.Unlock()
+
+	s, has := q.sessionHash[Id]
+	if !has {
+		j, has := q.jobHash[Id]
+		if !has {
+			return ErrNotExistJob
+		}
+		s = &session{
+			job:       j,
+			user:      j.status.User,
+			createdAt: j.status.CreatedAt,
+		}
+	}
+	if !s.detachedAt.IsZero() || !isActive(s.job.status.State) {
+		return ErrJobFinished
+	}
+	s.detachedAt = time.Now()
+	q.sessionHash[Id] = s
+	return nil
+}
+
+func (q *Queue) Get(Id string) (*Status, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	if s, has := q.sessionHash[Id]; has {
+		return q.sessionStatus(Id, s), nil
+	}
+	j, has := q.jobHash[Id]
+	if !has {
+		return nil, ErrNotExistJob
+	}
+	return q.status(j), nil
+}
+
+func (q *Queue) List() []*Status {
+	q.Lock()
+	defer q.Unlock()
+
+	list := make([]*Status, 0, len(q.jobHash)+len(q.sessionHash))
+	for Id, j := range q.jobHash {
+		if _, has := q.sessionHash[Id]; !has {
+			list = append(list, q.status(j))
+		}
+	}
+	for Id, s := range q.sessionHash {
+		list = append(list, q.sessionStatus(Id, s))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+func (q *Queue) Cancel(Id string) error {
+	q.Lock()
+	j, has := q.jobHash[Id]
+	if !has {
+		q.Unlock()
+		return ErrNotExistJob
+	}
+	if !isActive(j.status.State) {
+		q.Unlock()
+		return ErrJobFinished
+	}
+	q.Unlock()
+
+	j.cancel()
+	q.dequeue(j)
+	return nil
+}
+
+func (q *Queue) work() {
+	for {
+		q.Lock()
+		for len(q.users) == 0 {
+			q.cond.Wait()
+		}
+		User := q.users[0]
+		jobs := q.pending[User]
+		j := jobs[0]
+		if len(jobs) == 1 {
+			delete(q.pending, User)
+			q.users = q.users[1:]
+		} else {
+			q.pending[User] = jobs[1:]
+			q.users = append(q.users[1:], User)
+		}
+		j.status.State = StateBuilding
+		j.status.StartedAt = time.Now()
+		q.Unlock()
+
+		err := j.run(j.ctx)
+
+		q.Lock()
+		j.err = err
+		if err == nil {
+			j.status.State = StateSucceeded
+		} else if j.ctx.Err() != nil {
+			j.status.State = StateCancelled
+		} else {
+			j.status.State = StateFailed
+			j.status.Error = err.Error()
+		}
+		j.status.FinishedAt = time.Now()
+		q.Unlock()
+		j.cancel()
+		close(j.done)
+	}
+}
+
+func (q *Queue) dequeue(j *Job) {
+	q.Lock()
+	if j.status.State != StateQueued {
+		q.Unlock()
+		return
+	}
+	User := j.status.User
+	jobs := q.pending[User]
+	for i, v := range jobs {
+		if v == j {
+			jobs = append(jobs[:i:i], jobs[i+1:]...)
+			break
+		}
+	}
+	if len(jobs) > 0 {
+		q.pending[User] = jobs
+	} else {
+		delete(q.pending, User)
+		for i, v := range q.users {
+			if v == User {
+				q.users = append(q.users[:i:i], q.users[i+1:]...)
+				break
+			}
+		}
+	}
+	j.err = j.ctx.Err()
+	j.status.State = StateCancelled
+	j.status.FinishedAt = time.Now()
+	q.Unlock()
+	close(j.done)
+}
+
+// position counts the jobs that start before j, following the turns of the users, plus one.
+func (q *Queue) position(j *Job) int {
+	jobs := q.pending[j.status.User]
+	k := 0
+	for k < len(jobs) && jobs[k] != j {
+		k++
+	}
+	Position := 1
+	before := true
+	for _, User := range q.users {
+		if User == j.status.User {
+			before = false
+			Position += k
+			continue
+		}
+		n := len(q.pending[User])
+		if before && n > k {
+			Position += k + 1
+		} else if n > k {
+			Position += k
+		} else {
+			Position += n
+		}
+	}
+	return Position
+}
+
+func (q *Queue) status(j *Job) *Status {
+	st := j.status
+	if st.State == StateQueued {
+		st.Position = q.position(j)
+	}
+	return &st
+}
+
+func (q *Queue) sessionStatus(Id string, s *session) *Status {
+	st := q.status(s.job)
+	if st.Id != Id {
+		st.Shared = st.Id
+	}
+	st.Id = Id
+	st.User = s.user
+	st.CreatedAt = s.createdAt
+	if !s.detachedAt.IsZero() {
+		st.State = StateCancelled
+		st.Position = 0
+		st.Error = ""
+		st.FinishedAt = s.detachedAt
+	}
+	return st
+}
+
+func isActive(State string) bool {
+	return State == StateQueued || State == StateBuilding
+}
+
+func (q *Queue) prune() {
+	now := time.Now()
+	for Id, s := range q.sessionHash {
+		st := q.sessionStatus(Id, s)
+		if !st.FinishedAt.IsZero() && now.Sub(st.FinishedAt) > q.retention {
+			delete(q.sessionHash, Id)
+		}
+	}
+	for Id, j := range q.jobHash {
+		if !j.status.FinishedAt.IsZero() && now.Sub(j.status.FinishedAt) > q.retention {
+			delete(q.jobHash, Id)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package jobqueue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPosition(t *testing.T) {
+	tests := []struct {
+		users []string
+		jobs  map[string]int
+		want  map[string][]int
+	}{
+		{
+			[]string{"a"},
+			map[string]int{"a": 3},
+			map[string][]int{"a": {1, 2, 3}},
+		},
+		{
+			[]string{"a", "b"},
+			map[string]int{"a": 3, "b": 1},
+			map[string][]int{"a": {1, 3, 4}, "b": {2}},
+		},
+		{
+			[]string{"b", "a", "c"},
+			map[string]int{"a": 2, "b": 2, "c": 1},
+			map[string][]int{"b": {1, 4}, "a": {2, 5}, "c": {3}},
+		},
+	}
+	for _, tt := range tests {
+		q := &Queue{
+			pending: make(map[string][]*Job),
+			users:   tt.users,
+		}
+		for _, User := range tt.users {
+			for i := 0; i < tt.jobs[User]; i++ {
+				q.pending[User] = append(q.pending[User], &Job{status: Status{User: User, State: StateQueued}})
+			}
+		}
+		for User, want := range tt.want {
+			for i, j := range q.pending[User] {
+				if got := q.position(j); got != want[i] {
+					t.Errorf("users %v: position of %s #%d = %d, want %d", tt.users, User, i, got, want[i])
+				}
+			}
+		}
+	}
+}
+
+func TestFairness(t *testing.T) {
+	q := NewQueue(1, time.Hour)
+
+	gate := make(chan struct{})
+	first := q.Submit(context.Background(), "gate", "a", func(ctx context.Context) error {
+		<-gate
+		return nil
+	})
+	for {
+		st, _ := q.Get(first.Id())
+		if st.State == StateBuilding {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var mutex sync.Mutex
+	order := make([]string, 0)
+	jobs := make([]*Job, 0)
+	for _, Id := range []string{"a1", "a2", "a3", "b1", "c1", "b2"} {
+		Id := Id
+		jobs = append(jobs, q.Submit(context.Background(), Id, Id[:1], func(ctx context.Context) error {
+			mutex.Lock()
+			order = append(order, Id)
+			mutex.Unlock()
+			return nil
+		}))
+	}
+	st, err := q.Get("a3")
+	if err != nil || st.Position != 6 {
+		t.Errorf("Get(a3) = %+v, %v, want position 6", st, err)
+	}
+	close(gate)
+	for _, j := range jobs {
+		if err := j.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := fmt.Sprint(order); got != "[a1 b1 c1 a2 b2 a3]" {
+		t.Errorf("order = %s", got)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	q := NewQueue(1, time.Hour)
+
+	gate := make(chan struct{})
+	defer close(gate)
+	q.Submit(context.Background(), "gate", "a", func(ctx context.Context) error {
+		<-gate
+		return nil
+	})
+	ran := false
+	j := q.Submit(context.Background(), "x", "b", func(ctx context.Context) error {
+		ran = true
+		return nil
+	})
+	if err := q.Cancel("x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Err(); err != context.Canceled {
+		t.Errorf("Err() = %v, want context.Canceled", err)
+	}
+	st, err := q.Get("x")
+	if err != nil || st.State != StateCancelled {
+		t.Errorf("Get(x) = %+v, %v", st, err)
+	}
+	if err := q.Cancel("x"); err != ErrJobFinished {
+		t.Errorf("Cancel twice = %v, want ErrJobFinished", err)
+	}
+	if err := q.Cancel("y"); err != ErrNotExistJob {
+		t.Errorf("Cancel(y) = %v, want ErrNotExistJob", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	k := q.Submit(ctx, "z", "b", func(ctx context.Context) error {
+		ran = true
+		return nil
+	})
+	cancel()
+	if err := k.Err(); err != context.Canceled {
+		t.Errorf("Err() after the context is canceled = %v", err)
+	}
+	if ran {
+		t.Errorf("a canceled job ran")
+	}
+}
+
+func TestJoinDetach(t *testing.T) {
+	q := NewQueue(1, time.Hour)
+
+	gate := make(chan struct{})
+	first := q.Submit(context.Background(), "gate", "a", func(ctx context.Context) error {
+		<-gate
+		return nil
+	})
+	for {
+		st, _ := q.Get(first.Id())
+		if st.State == StateBuilding {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	j := q.Submit(context.Background(), "x", "b", func(ctx context.Context) error {
+		return nil
+	})
+	q.Join("y", "c", j)
+	q.Join("z", "d", j)
+
+	st, err := q.Get("y")
+	if err != nil || st.State != StateQueued || st.Position != 1 || st.Shared != "x" || st.User != "c" {
+		t.Errorf("Get(y) = %+v, %v", st, err)
+	}
+	if err := q.Detach("y"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Detach("y"); err != ErrJobFinished {
+		t.Errorf("Detach twice = %v, want ErrJobFinished", err)
+	}
+	if err := q.Detach("w"); err != ErrNotExistJob {
+		t.Errorf("Detach(w) = %v, want ErrNotExistJob", err)
+	}
+	// the session that submitted the job leaves it to the others too
+	if err := q.Detach("x"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(q.List()); n != 4 {
+		t.Errorf("List() has %d jobs, want 4", n)
+	}
+
+	close(gate)
+	if err := j.Err(); err != nil {
+		t.Fatal(err)
+	}
+	for Id, want := range map[string]string{"x": StateCancelled, "y": StateCancelled, "z": StateSucceeded} {
+		st, err := q.Get(Id)
+		if err != nil || st.State != want {
+			t.Errorf("Get(%s) = %+v, %v, want %s", Id, st, err, want)
+		}
+	}
+	if err := q.Detach("z"); err != ErrJobFinished {
+		t.Errorf("Detach after the job = %v, want ErrJobFinished", err)
+	}
+}
@@ -0,0 +1,53 @@
+package packer
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/blackss2/devfarm/common"
+	"github.com/blackss2/devfarm/utils"
+)
+
+func PackBinary(BinaryPath string, Args []string, UseGitIgnore bool) (*utils.FileList, error) {
+	curDir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(BinaryPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotExistSource
+		}
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, ErrNotExistSource
+	}
+
+	fl := &utils.FileList{}
+	ig := newIgnorer(UseGitIgnore)
+	ig.AddPatterns(curDir, ResourceIgnorePatterns)
+	err = fl.AddDir(curDir, "__resources", ig)
+	if err != nil {
+		return nil, err
+	}
+
+	fl.AddFile(BinaryPath, "bin/"+filepath.Base(BinaryPath))
+	fl.Entries[len(fl.Entries)-1].Mode = 0755
+
+	data, err := json.Marshal(&common.Manifest{
+		User:     utils.CurrentUser(),
+		Command:  "exec",
+		Packages: filepath.Base(BinaryPath),
+		Args:     Args,
+	})
+	if err != nil {
+		return nil, err
+	}
+	fl.AddData("manifest.json", data)
+	fl.Sort()
+
+	return fl, nil
+}
@@ -0,0 +1,290 @@
+package packer
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/blackss2/devfarm/utils"
+)
+
+func (pc *packContext) packModule(mod *utils.Module) (bool, bool, error) {
+	workFile, err := utils.FindWorkspace(mod.Dir)
+	if err != nil {
+		return false, false, err
+	}
+
+	if len(workFile) == 0 {
+		if _, err := os.Stat(filepath.Join(mod.Dir, "vendor", "modules.txt")); err == nil {
+			ig := newIgnorer(pc.useGitIgnore)
+			ig.AddPatterns(mod.Dir, ModuleIgnorePatterns)
+			err = pc.fl.AddDir(mod.Dir, "src/"+mod.Path, ig)
+			if err != nil {
+				return false, false, err
+			}
+			return true, false, nil
+		}
+	}
+
+	Modules, err := utils.ListModules(mod.Dir)
+	if err != nil {
+		return false, false, err
+	}
+
+	locals := localModules(Modules)
+	for _, l := range locals {
+		if isShippedWith(l, locals) {
+			continue
+		}
+
+		ig := newIgnorer(pc.useGitIgnore)
+		ig.AddPatterns(l.Dir, ModuleIgnorePatterns)
+		for _, v := range locals {
+			if v.Main && (v == l || isShippedWith(v, []*utils.Module{l})) {
+				rel, err := filepath.Rel(l.Dir, v.Dir)
+				if err != nil {
+					return false, false, err
+				}
+				ig.AddPatterns(l.Dir, []string{"/" + path.Join(filepath.ToSlash(rel), "go.mod")})
+			}
+		}
+		err = pc.fl.AddDir(l.Dir, "src/"+l.Path, ig)
+		if err != nil {
+			return false, false, err
+		}
+	}
+
+	for _, l := range locals {
+		if !l.Main {
+			continue
+		}
+		gomod := filepath.Join(l.Dir, "go.mod")
+		replaces, err := utils.ReadModuleReplaces(gomod)
+		if err != nil {
+			return false, false, err
+		}
+		Edits := make([]string, 0)
+		for _, r := range replaces {
+			if !r.IsLocal() {
+				continue
+			}
+			if target := localReplaceTarget(l.Dir, r, locals); target != nil {
+				Edits = append(Edits, "-replace="+r.OldString()+"="+relModulePath(l.Path, target.Path))
+			} else {
+				Edits = append(Edits, "-dropreplace="+r.OldString())
+			}
+		}
+		data, err := utils.EditModFile(gomod, Edits)
+		if err != nil {
+			return false, false, err
+		}
+		pc.fl.AddData("src/"+l.Path+"/go.mod", data)
+	}
+
+	if len(workFile) > 0 {
+		err = pc.packWorkspace(workFile, locals)
+		if err != nil {
+			return false, false, err
+		}
+	}
+
+	err = pc.packModCache(Modules)
+	if err != nil {
+		return false, false, err
+	}
+	return false, len(workFile) > 0, nil
+}
+
+func (pc *packContext) packWorkspace(workFile string, locals []*utils.Module) error {
+	ws, err := utils.ReadWorkspace(workFile)
+	if err != nil {
+		return err
+	}
+
+	var content strings.Builder
+	if len(ws.Go) > 0 {
+		fmt.Fprintf(&content, "go %s\n\n", ws.Go)
+	}
+	content.WriteString("use (\n")
+	for _, l := range locals {
+		if l.Main {
+			fmt.Fprintf(&content, "\t./%s\n", l.Path)
+		}
+	}
+	content.WriteString(")\n")
+	for _, r := range ws.Replace {
+		if r.IsLocal() {
+			target := localReplaceTarget(filepath.Dir(workFile), r, locals)
+			if target == nil {
+				continue
+			}
+			fmt.Fprintf(&content, "\nreplace %s => ./%s\n", strings.Replace(r.OldString(), "@", " ", 1), target.Path)
+		} else {
+			fmt.Fprintf(&content, "\nreplace %s => %s %s\n", strings.Replace(r.OldString(), "@", " ", 1), r.New.Path, r.New.Version)
+		}
+	}
+
+	pc.fl.AddData("src/go.work", []byte(content.String()))
+
+	workSum := workFile + ".sum"
+	if _, err := os.Stat(workSum); err == nil {
+		pc.fl.AddFile(workSum, "src/go.work.sum")
+	}
+	return nil
+}
+
+func localModules(Modules []*utils.Module) []*utils.Module {
+	locals := make([]*utils.Module, 0)
+	for _, m := range Modules {
+		if len(m.Dir) == 0 {
+			continue
+		}
+		if m.Main || (m.Replace != nil && m.Replace.Version == "") {
+			locals = append(locals, &utils.Module{
+				Path: m.Path,
+				Dir:  m.Dir,
+				Main: m.Main,
+			})
+		}
+	}
+	sort.Slice(locals, func(i, j int) bool {
+		return locals[i].Path < locals[j].Path
+	})
+	return locals
+}
+
+func isShippedWith(l *utils.Module, locals []*utils.Module) bool {
+	for _, v := range locals {
+		if v == l {
+			continue
+		}
+		rel, err := filepath.Rel(v.Dir, l.Dir)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		if path.Join(v.Path, filepath.ToSlash(rel)) == l.Path {
+			return true
+		}
+	}
+	return false
+}
+
+func localReplaceTarget(baseDir string, r *utils.Replace, locals []*utils.Module) *utils.Module {
+	dir := r.New.Path
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(baseDir, dir)
+	}
+	dir = filepath.Clean(dir)
+	for _, l := range locals {
+		if l.Dir == dir {
+			return l
+		}
+	}
+	return nil
+}
+
+func relModulePath(from string, to string) string {
+	rel, err := filepath.Rel("/"+from, "/"+to)
+	if err != nil {
+		return "./" + to
+	}
+	rel = filepath.ToSlash(rel)
+	if !strings.HasPrefix(rel, "../") {
+		rel = "./" + rel
+	}
+	return rel
+}
+
+func modulePackages(mod *utils.Module, srcPath string, isRecursive bool) (string, error) {
+	rel, err := filepath.Rel(mod.Dir, srcPath)
+	if err != nil {
+		return "", err
+	}
+	pattern := "./" + filepath.ToSlash(rel)
+	if rel == "." {
+		pattern = "."
+	}
+	if isRecursive {
+		pattern = strings.TrimSuffix(pattern, "/") + "/..."
+	}
+	return pattern, nil
+}
+
+func (pc *packContext) packModCache(Modules []*utils.Module) error {
+	modCache, err := utils.GoEnv("GOMODCACHE")
+	if err != nil {
+		return err
+	}
+
+	deps, err := pc.importList(Modules)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range Modules {
+		if m.Main {
+			continue
+		}
+		src := m
+		if m.Replace != nil {
+			src = m.Replace
+		}
+		if len(src.Version) == 0 {
+			continue
+		}
+
+		escPath := utils.EscapeModulePath(src.Path)
+		escVersion := utils.EscapeModulePath(src.Version)
+		downloadDir := filepath.Join(modCache, "cache", "download", filepath.FromSlash(escPath), "@v")
+		prefix := "mod/" + escPath + "/@v/"
+
+		exts := []string{".info", ".mod"}
+		importedBy := moduleImports(m.Path, deps)
+		if len(importedBy) > 0 {
+			exts = append(exts, ".zip", ".ziphash")
+		}
+		for _, ext := range exts {
+			localPath := filepath.Join(downloadDir, escVersion+ext)
+			if _, err := os.Stat(localPath); err != nil {
+				if os.IsNotExist(err) && (ext == ".mod" || ext == ".zip") {
+					if len(importedBy) > 0 {
+						return fmt.Errorf("%s@%s: %v: %s", src.Path, src.Version, ErrNotDownloaded, joinDependencies(importedBy))
+					}
+					return fmt.Errorf("%s@%s: %v", src.Path, src.Version, ErrNotDownloaded)
+				}
+				if os.IsNotExist(err) {
+					continue
+				}
+				return err
+			}
+			pc.fl.AddFile(localPath, prefix+escVersion+ext)
+		}
+		if pc.verbose {
+			for _, v := range importedBy {
+				fmt.Fprintf(os.Stderr, "devfarm: ship %s@%s for %s\n", src.Path, src.Version, v)
+			}
+		}
+	}
+	return nil
+}
+
+func moduleImports(modPath string, deps []*utils.Dependency) []*utils.Dependency {
+	list := make([]*utils.Dependency, 0)
+	for _, v := range deps {
+		if v.ImportPath == modPath || strings.HasPrefix(v.ImportPath, modPath+"/") {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func joinDependencies(deps []*utils.Dependency) string {
+	list := make([]string, 0, len(deps))
+	for _, v := range deps {
+		list = append(list, v.String())
+	}
+	return strings.Join(list, "; ")
+}
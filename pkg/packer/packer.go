@@ -2,13 +2,14 @@ package packer
 
 import (
 	"archive/zip"
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	_ "github.com/blackss2/utility/convert" //TEMP
 
@@ -16,39 +17,86 @@ import (
 	"github.com/blackss2/devfarm/utils"
 )
 
+const (
+	DefaultGOOS   = "linux"
+	DefaultGOARCH = "amd64"
+)
+
+var (
+	ResourceIgnorePatterns = []string{
+		"/bin/",
+		"/pkg/",
+		"/src/",
+		"/__resources/",
+		".git/",
+		".settings/",
+		".project",
+	}
+	ModuleIgnorePatterns = []string{
+		"/__resources/",
+		".git/",
+		".settings/",
+		".project",
+	}
+)
+
 var (
 	ErrNotExistSource    = errors.New("not exist source")
 	ErrNotSupportCommand = errors.New("not support command")
 	ErrUnknownPackage    = errors.New("unknown packages")
+	ErrNotDownloaded     = errors.New("module is not in local module cache (run go mod download)")
 )
 
-func PackSourceZip(Command string, BuildFlags []string, Packages string) ([]byte, error) {
-	if Command != "install" && Command != "build" {
-		return nil, ErrNotSupportCommand
+type Options struct {
+	GoVersion    string
+	BuildOnly    bool
+	UseGitIgnore bool
+	Args         []string
+	Env          []string
+	PortInterval time.Duration
+	Limits       *common.RunLimits
+	Verbose      bool
+	// Targets are extra platforms whose imports are shipped too; empty fields keep the default target, nil Tags keep -tags
+	Targets []*utils.BuildTarget
+}
+
+func PackSourceZip(w io.Writer, Command string, BuildFlags []string, Packages string, opts *Options) error {
+	fl, err := PackSource(Command, BuildFlags, Packages, opts)
+	if err != nil {
+		return err
 	}
 
-	curDir, err := os.Getwd()
+	zw := zip.NewWriter(w)
+	err = utils.WriteEntriesToZip(zw, fl.Entries)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return zw.Close()
+}
 
-	var buffer bytes.Buffer
-	zw := zip.NewWriter(&buffer)
-	ignorePrefix := []string{
-		"bin/",
-		"pkg/",
-		"src/",
-		"__resources/",
-		".git/",
-		".settings/",
-		".project",
+func PackSource(Command string, BuildFlags []string, Packages string, opts *Options) (*utils.FileList, error) {
+	if Command != "install" && Command != "build" && Command != "test" {
+		return nil, ErrNotSupportCommand
 	}
-	err = utils.AddDirToZip(zw, curDir, "__resources", ignorePrefix)
+	if opts == nil {
+		opts = &Options{}
+	}
+	UseGitIgnore := opts.UseGitIgnore
+
+	curDir, err := os.Getwd()
 	if err != nil {
 		return nil, err
 	}
 
-	srcPath, err := filepath.Abs(filepath.Clean(fmt.Sprintf("%s/%s", curDir, Packages)))
+	fl := &utils.FileList{}
+	pkgDir := Packages
+	isRecursive := false
+	if strings.HasSuffix(pkgDir, "...") {
+		pkgDir = strings.TrimSuffix(pkgDir, "...")
+		isRecursive = true
+	}
+
+	srcPath, err := filepath.Abs(filepath.Clean(fmt.Sprintf("%s/%s", curDir, pkgDir)))
 	if err != nil {
 		return nil, err
 	}
@@ -62,51 +110,212 @@ func PackSourceZip(Command string, BuildFlags []string, Packages string) ([]byte
 		}
 	}
 
-	prefix := filepath.Clean(Packages)
-	if prefix == "..." || prefix == "." {
-		prefix = ""
-	}
-	err = utils.AddDirToZip(zw, srcPath, "src/"+prefix, nil)
+	mod, err := utils.FindModule(srcPath)
 	if err != nil {
 		return nil, err
 	}
 
-	importPaths, err := utils.GetTotalImportList(srcPath, os.Getenv("GOPATH"), curDir)
+	ig := newIgnorer(UseGitIgnore)
+	ig.AddPatterns(curDir, ResourceIgnorePatterns)
+	if mod != nil {
+		err = ig.LoadParents(mod.Dir, curDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = fl.AddDir(curDir, "__resources", ig)
 	if err != nil {
 		return nil, err
 	}
 
-	goPaths := []string{os.Getenv("GOPATH"), curDir}
-	for _, v := range importPaths {
-		for _, goPath := range goPaths {
-			if strings.HasPrefix(v, goPath) {
-				rel, err := filepath.Rel(goPath+"/src", v)
-				if err != nil {
-					return nil, err
-				}
-				err = utils.AddDirToZip(zw, v, "src/"+rel, nil)
-				if err != nil {
-					return nil, err
+	GOOS, GOARCH, CgoEnabled := TargetPlatform()
+	target := &utils.BuildTarget{
+		GOOS:       DefaultGOOS,
+		GOARCH:     DefaultGOARCH,
+		Tags:       utils.ParseBuildTags(BuildFlags),
+		Tests:      Command == "test",
+		CgoEnabled: CgoEnabled != "0",
+	}
+	if len(GOOS) > 0 {
+		target.GOOS = GOOS
+	}
+	if len(GOARCH) > 0 {
+		target.GOARCH = GOARCH
+	}
+	targets := []*utils.BuildTarget{target}
+	for _, v := range opts.Targets {
+		t := *target
+		if len(v.GOOS) > 0 {
+			t.GOOS = v.GOOS
+		}
+		if len(v.GOARCH) > 0 {
+			t.GOARCH = v.GOARCH
+		}
+		if v.Tags != nil {
+			t.Tags = v.Tags
+		}
+		targets = append(targets, &t)
+	}
+
+	pc := &packContext{
+		fl:           fl,
+		srcPath:      srcPath,
+		isRecursive:  isRecursive,
+		targets:      targets,
+		useGitIgnore: UseGitIgnore,
+		verbose:      opts.Verbose,
+	}
+
+	var Module string
+	var Vendor, Workspace bool
+	if mod != nil {
+		Module = mod.Path
+		Packages, err = modulePackages(mod, srcPath, isRecursive)
+		if err != nil {
+			return nil, err
+		}
+
+		Vendor, Workspace, err = pc.packModule(mod)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		prefix := filepath.Clean(Packages)
+		if prefix == "..." || prefix == "." {
+			prefix = ""
+		}
+		err = fl.AddDir(srcPath, "src/"+prefix, newIgnorer(UseGitIgnore))
+		if err != nil {
+			return nil, err
+		}
+
+		goPaths := []string{os.Getenv("GOPATH"), curDir}
+		deps, err := pc.importList(nil, goPaths...)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range deps {
+			for _, goPath := range goPaths {
+				if strings.HasPrefix(v.Dir, goPath) {
+					rel, err := filepath.Rel(goPath+"/src", v.Dir)
+					if err != nil {
+						return nil, err
+					}
+					err = fl.AddDir(v.Dir, "src/"+rel, newIgnorer(UseGitIgnore))
+					if err != nil {
+						return nil, err
+					}
+					break
 				}
-				break
 			}
 		}
 	}
 
-	fw, err := zw.Create("manifest.json")
+	fl.Sort()
+	SourceDigest, err := fl.Digest()
 	if err != nil {
 		return nil, err
 	}
+
 	data, err := json.Marshal(&common.Manifest{
+		User:       utils.CurrentUser(),
 		Command:    Command,
 		BuildFlags: BuildFlags,
 		Packages:   Packages,
+		Module:     Module,
+		Vendor:     Vendor,
+		Workspace:  Workspace,
+		GoVersion:  opts.GoVersion,
+		GOOS:       GOOS,
+		GOARCH:     GOARCH,
+		CgoEnabled: CgoEnabled,
+		BuildOnly:  opts.BuildOnly,
+		Args:       opts.Args,
+		Env:        opts.Env,
+
+		PortInterval: opts.PortInterval,
+		Limits:       opts.Limits,
+
+		SourceDigest: SourceDigest,
 	})
 	if err != nil {
 		return nil, err
 	}
-	fw.Write(data)
-	zw.Close()
+	fl.AddData("manifest.json", data)
+	fl.Sort()
+
+	return fl, nil
+}
+
+func TargetPlatform() (string, string, string) {
+	return os.Getenv("GOOS"), os.Getenv("GOARCH"), os.Getenv("CGO_ENABLED")
+}
+
+func LocalPath(fl *utils.FileList, File string) string {
+	for _, fe := range fl.Entries {
+		if fe.Path == File && len(fe.LocalPath) > 0 {
+			return fe.LocalPath
+		}
+	}
+	if strings.HasPrefix(File, "pkg/mod/") {
+		modCache, err := utils.GoEnv("GOMODCACHE")
+		if err == nil && len(modCache) > 0 {
+			return filepath.Join(modCache, filepath.FromSlash(strings.TrimPrefix(File, "pkg/mod/")))
+		}
+	}
+	return File
+}
+
+type packContext struct {
+	fl           *utils.FileList
+	srcPath      string
+	isRecursive  bool
+	targets      []*utils.BuildTarget
+	useGitIgnore bool
+	verbose      bool
+}
+
+// importList merges the imports of every target, so a matrix cell never misses a platform-only dependency
+func (pc *packContext) importList(Modules []*utils.Module, goPaths ...string) ([]*utils.Dependency, error) {
+	deps := make([]*utils.Dependency, 0)
+	depHash := make(map[string]*utils.Dependency)
+	for _, target := range pc.targets {
+		list, err := utils.GetTotalImportList(pc.srcPath, pc.isRecursive, target, Modules, goPaths...)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range list {
+			if dep, has := depHash[v.ImportPath]; has {
+				dep.ImportedBy = appendImportSources(dep.ImportedBy, v.ImportedBy)
+				continue
+			}
+			depHash[v.ImportPath] = v
+			deps = append(deps, v)
+		}
+	}
+	return deps, nil
+}
+
+func appendImportSources(list []*utils.ImportSource, sources []*utils.ImportSource) []*utils.ImportSource {
+	for _, v := range sources {
+		has := false
+		for _, s := range list {
+			if s.Package == v.Package && s.File == v.File {
+				has = true
+				break
+			}
+		}
+		if !has {
+			list = append(list, v)
+		}
+	}
+	return list
+}
 
-	return buffer.Bytes(), nil
+func newIgnorer(UseGitIgnore bool) *utils.Ignorer {
+	if UseGitIgnore {
+		return utils.NewIgnorer(utils.GitIgnoreFileName, utils.IgnoreFileName)
+	}
+	return utils.NewIgnorer(utils.IgnoreFileName)
 }
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package runner
+
+import (
+	"os"
+)
+
+func exitSignal(state *os.ProcessState) (string, int) {
+	return "", 0
+}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package runner
+
+import (
+	"os"
+	"syscall"
+)
+
+func exitSignal(state *os.ProcessState) (string, int) {
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return ws.Signal().String(), int(ws.Signal())
+	}
+	return "", 0
+}
@@ -0,0 +1,179 @@
+package runner
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/blackss2/devfarm/common"
+)
+
+const (
+	gTcpListen  = "0A"
+	gUdpUnbound = "07"
+	gSocketLink = "socket:["
+	gProcRoot   = "/proc"
+)
+
+// ListenPorts returns the listening tcp sockets and the bound udp sockets
+// of the process pid and all of its descendants.
+func ListenPorts(pid int) ([]*common.ListenPort, error) {
+	pids, err := processTree(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	inodeHash := make(map[string]bool)
+	for _, v := range pids {
+		links, err := ioutil.ReadDir(fmt.Sprintf("%s/%d/fd", gProcRoot, v))
+		if err != nil {
+			// the process exited or is not ours
+			continue
+		}
+		for _, link := range links {
+			target, err := os.Readlink(fmt.Sprintf("%s/%d/fd/%s", gProcRoot, v, link.Name()))
+			if err != nil || !strings.HasPrefix(target, gSocketLink) {
+				continue
+			}
+			inodeHash[target[len(gSocketLink):len(target)-1]] = true
+		}
+	}
+	if len(inodeHash) == 0 {
+		return []*common.ListenPort{}, nil
+	}
+
+	ports := make([]*common.ListenPort, 0)
+	seen := make(map[string]bool)
+	for _, Proto := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		// the network namespace of the program may differ from the one of the server
+		list, err := parseProcNet(fmt.Sprintf("%s/%d/net/%s", gProcRoot, pid, Proto), Proto, inodeHash)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, lp := range list {
+			if !seen[lp.String()] {
+				seen[lp.String()] = true
+				ports = append(ports, lp)
+			}
+		}
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].Port != ports[j].Port {
+			return ports[i].Port < ports[j].Port
+		}
+		if ports[i].Proto != ports[j].Proto {
+			return ports[i].Proto < ports[j].Proto
+		}
+		return ports[i].Addr < ports[j].Addr
+	})
+	return ports, nil
+}
+
+func parseProcNet(path string, Proto string, inodeHash map[string]bool) ([]*common.ListenPort, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	state := gTcpListen
+	if strings.HasPrefix(Proto, "udp") {
+		state = gUdpUnbound
+	}
+
+	ports := make([]*common.ListenPort, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[3] != state || !inodeHash[fields[9]] {
+			continue
+		}
+		ip, port, err := parseHexAddr(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		if port == 0 {
+			continue
+		}
+		ports = append(ports, &common.ListenPort{
+			Proto: Proto,
+			Addr:  ip.String(),
+			Port:  port,
+		})
+	}
+	return ports, scanner.Err()
+}
+
+// parseHexAddr decodes an address of /proc/net, like 0100007F:1F90,
+// where the ip is printed as 32 bit words read in host byte order.
+func parseHexAddr(s string) (net.IP, int, error) {
+	idx := strings.Index(s, ":")
+	if idx < 0 {
+		return nil, 0, fmt.Errorf("invalid address: %s", s)
+	}
+	bs, err := hex.DecodeString(s[:idx])
+	if err != nil || (len(bs) != net.IPv4len && len(bs) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("invalid address: %s", s)
+	}
+	port, err := strconv.ParseUint(s[idx+1:], 16, 16)
+	if err != nil {
+		return nil, 0, err
+	}
+	ip := make(net.IP, len(bs))
+	for i := 0; i < len(bs); i += 4 {
+		binary.NativeEndian.PutUint32(ip[i:], binary.BigEndian.Uint32(bs[i:]))
+	}
+	return ip, int(port), nil
+}
+
+func processTree(pid int) ([]int, error) {
+	entries, err := ioutil.ReadDir(gProcRoot)
+	if err != nil {
+		return nil, err
+	}
+	childrenHash := make(map[int][]int)
+	for _, entry := range entries {
+		child, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(gProcRoot, entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// pid (comm) state ppid ..., comm may contain spaces and parentheses
+		stat := string(data)
+		idx := strings.LastIndex(stat, ")")
+		if idx < 0 {
+			continue
+		}
+		fields := strings.Fields(stat[idx+1:])
+		if len(fields) < 2 {
+			continue
+		}
+		ppid, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		childrenHash[ppid] = append(childrenHash[ppid], child)
+	}
+
+	pids := []int{pid}
+	for i := 0; i < len(pids); i++ {
+		pids = append(pids, childrenHash[pids[i]]...)
+	}
+	return pids, nil
+}
@@ -0,0 +1,151 @@
+package runner
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blackss2/devfarm/common"
+)
+
+// procHex prints ip and port the way the kernel does in /proc/net
+func procHex(ip net.IP, port int) string {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	var sb strings.Builder
+	for i := 0; i < len(ip); i += 4 {
+		fmt.Fprintf(&sb, "%08X", binary.NativeEndian.Uint32(ip[i:]))
+	}
+	return fmt.Sprintf("%s:%04X", sb.String(), port)
+}
+
+func TestParseHexAddr(t *testing.T) {
+	tests := []struct {
+		ip   string
+		port int
+	}{
+		{"127.0.0.1", 8080},
+		{"0.0.0.0", 53},
+		{"10.1.2.3", 65535},
+		{"::", 443},
+		{"::1", 22},
+		{"fe80::1:2:3:4", 8443},
+	}
+	for _, tt := range tests {
+		s := procHex(net.ParseIP(tt.ip), tt.port)
+		ip, port, err := parseHexAddr(s)
+		if err != nil || ip.String() != tt.ip || port != tt.port {
+			t.Errorf("parseHexAddr(%q) = %v, %d, %v, want %s, %d", s, ip, port, err, tt.ip, tt.port)
+		}
+	}
+
+	if binary.NativeEndian.Uint16([]byte{1, 0}) == 1 {
+		ip, port, err := parseHexAddr("0100007F:1F90")
+		if err != nil || ip.String() != "127.0.0.1" || port != 8080 {
+			t.Errorf("parseHexAddr on a little endian host = %v, %d, %v", ip, port, err)
+		}
+	}
+
+	for _, s := range []string{"", "0100007F", "0100007F:", "01007F:1F90", "XX00007F:1F90", "0100007F:10000"} {
+		if _, _, err := parseHexAddr(s); err == nil {
+			t.Errorf("parseHexAddr(%q) succeeded", s)
+		}
+	}
+}
+
+func TestParseProcNet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "devfarm_runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	local := procHex(net.ParseIP("127.0.0.1"), 8080)
+	wild := procHex(net.ParseIP("0.0.0.0"), 9090)
+	remote := procHex(net.ParseIP("10.0.0.1"), 40000)
+	unbound := procHex(net.ParseIP("0.0.0.0"), 0)
+	dns := procHex(net.ParseIP("0.0.0.0"), 5353)
+	lines := []string{
+		"  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode",
+		"   0: " + local + " 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 100 1 0000000000000000 100 0 0 10 0",
+		"   1: " + wild + " 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 200 1 0000000000000000 100 0 0 10 0",
+		"   2: " + local + " " + remote + " 01 00000000:00000000 00:00000000 00000000     0        0 100 1 0000000000000000 100 0 0 10 0",
+		"   3: " + wild + " 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 300 1 0000000000000000 100 0 0 10 0",
+		"   4: " + unbound + " 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 400 1 0000000000000000 100 0 0 10 0",
+		"   5: " + dns + " 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 500 1 0000000000000000 100 0 0 10 0",
+		"   6: short",
+	}
+	path := filepath.Join(dir, "tcp")
+	err = ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Proto     string
+		inodeHash map[string]bool
+		want      []*common.ListenPort
+	}{
+		{"tcp", map[string]bool{"100": true, "200": true}, []*common.ListenPort{
+			{Proto: "tcp", Addr: "127.0.0.1", Port: 8080},
+			{Proto: "tcp", Addr: "0.0.0.0", Port: 9090},
+		}},
+		{"tcp", map[string]bool{"999": true}, []*common.ListenPort{}},
+		// udp sockets are bound in state 07, not listening
+		{"udp", map[string]bool{"100": true}, []*common.ListenPort{}},
+		// a socket not bound yet has port 0
+		{"udp", map[string]bool{"400": true, "500": true}, []*common.ListenPort{
+			{Proto: "udp", Addr: "0.0.0.0", Port: 5353},
+		}},
+	}
+	for _, tt := range tests {
+		got, err := parseProcNet(path, tt.Proto, tt.inodeHash)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseProcNet(%s, %v) = %v, %v, want %v", tt.Proto, tt.inodeHash, got, err, tt.want)
+		}
+	}
+
+	if _, err := parseProcNet(filepath.Join(dir, "none"), "tcp", nil); !os.IsNotExist(err) {
+		t.Errorf("parseProcNet of a missing file = %v", err)
+	}
+}
+
+func TestProcessTree(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "sleep 10 & wait")
+	if err := cmd.Start(); err != nil {
+		t.Skip(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	for i := 0; i < 100; i++ {
+		pids, err := processTree(os.Getpid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pids[0] != os.Getpid() {
+			t.Fatalf("processTree starts with %d", pids[0])
+		}
+		// the shell and its sleep
+		has := false
+		for _, v := range pids {
+			if v == cmd.Process.Pid {
+				has = true
+			}
+		}
+		if has && len(pids) >= 3 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("processTree misses the descendants")
+}
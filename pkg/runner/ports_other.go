@@ -0,0 +1,11 @@
+//go:build !linux
+
+package runner
+
+import (
+	"github.com/blackss2/devfarm/common"
+)
+
+func ListenPorts(pid int) ([]*common.ListenPort, error) {
+	return nil, ErrNotSupportPorts
+}
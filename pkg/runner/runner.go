@@ -2,8 +2,9 @@ package runner
 
 import (
 	"archive/zip"
-	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,40 +13,62 @@ import (
 	"path/filepath"
 	"runtime"
 	"sort"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/blackss2/devfarm/common"
+	"github.com/blackss2/devfarm/pkg/sandbox"
+	"github.com/blackss2/devfarm/utils"
 )
 
-func RunFromBinaryZip(ctx context.Context, data []byte, inChan io.Reader, outChan io.Writer, errChan io.Writer, portChan io.Writer) error {
-	BinaryFiles, err := UnpackBinaryZip(data)
-	if err != nil {
-		return err
-	}
+// gPassEnvKeys are the only variables of the server environment given to the program.
+var gPassEnvKeys = []string{"PATH", "LANG", "TZ", "SYSTEMROOT"}
+
+const (
+	gWaitDelay       = 5 * time.Second
+	gPortInterval    = time.Second
+	gMinPortInterval = 100 * time.Millisecond
+)
+
+var (
+	ErrNotSupportPorts = errors.New("not support ports")
+)
 
-	err = RunBinary(ctx, BinaryFiles, inChan, outChan, errChan, portChan)
+type Options struct {
+	Args         []string
+	Env          []string
+	PortInterval time.Duration
+	Limits       sandbox.Limits
+	CgroupRoot   string
+}
+
+func RunFromBinaryZip(ctx context.Context, r io.ReaderAt, size int64, opts *Options, inChan io.Reader, outChan io.Writer, errChan io.Writer, portChan io.Writer) (*common.RunResult, error) {
+	BinaryFiles, err := UnpackBinaryZip(r, size)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return RunBinary(ctx, BinaryFiles, opts, inChan, outChan, errChan, portChan)
 }
 
-func UnpackBinaryZip(data []byte) ([]*common.BinaryFile, error) {
-	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+func UnpackBinaryZip(r io.ReaderAt, size int64) ([]*common.BinaryFile, error) {
+	zr, err := zip.NewReader(r, size)
 	if err != nil {
 		return nil, err
 	}
 
 	BinaryFiles := make([]*common.BinaryFile, 0, len(zr.File)-1)
 	for _, file := range zr.File {
+		Path, err := utils.CleanArchivePath(file.Name)
+		if err != nil {
+			return nil, err
+		}
 		fr, err := file.Open()
 		if err != nil {
 			return nil, err
 		}
 		bf := &common.BinaryFile{
-			Path:       file.Name,
+			Path:       Path,
+			Mode:       file.Mode(),
 			ReadCloser: fr,
 		}
 		BinaryFiles = append(BinaryFiles, bf)
@@ -53,10 +76,14 @@ func UnpackBinaryZip(data []byte) ([]*common.BinaryFile, error) {
 	return BinaryFiles, nil
 }
 
-func RunBinary(ctx context.Context, BinaryFiles []*common.BinaryFile, inChan io.Reader, outChan io.Writer, errChan io.Writer, portChan io.Writer) error {
+func RunBinary(ctx context.Context, BinaryFiles []*common.BinaryFile, opts *Options, inChan io.Reader, outChan io.Writer, errChan io.Writer, portChan io.Writer) (*common.RunResult, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
 	tempDir, err := ioutil.TempDir("", "devfarm_runner")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer os.RemoveAll(tempDir)
 
@@ -78,47 +105,51 @@ func RunBinary(ctx context.Context, BinaryFiles []*common.BinaryFile, inChan io.
 		if !nodeMarker[i] {
 			err := os.MkdirAll(fmt.Sprintf(`%s/%s`, tempDir, v), os.ModeDir)
 			if err != nil {
-				return err
+				return nil, err
 			}
 		}
 	}
 
+	// nothing is touched before every link is known to stay in tempDir
+	for _, bf := range BinaryFiles {
+		err := utils.WriteZipEntry(tempDir, bf.Path, bf.Mode, bf.ReadCloser)
+		bf.ReadCloser.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	names := make([]string, 0, len(BinaryFiles))
+	for _, bf := range BinaryFiles {
+		names = append(names, bf.Path)
+	}
+	err = utils.CheckSymlinks(tempDir, names)
+	if err != nil {
+		return nil, err
+	}
+
 	var binFile string
 	hasResource := false
-	for _, v := range BinaryFiles {
-		err := func(bf *common.BinaryFile) error {
-			path := fmt.Sprintf(`%s/%s`, tempDir, bf.Path)
-			file, err := os.Create(path)
-			if err != nil {
-				return err
-			}
-			defer file.Close()
-			_, err = io.Copy(file, bf.ReadCloser)
+	for _, bf := range BinaryFiles {
+		if strings.HasPrefix(bf.Path, "__resources") {
+			hasResource = true
+			continue
+		}
+		if filepath.Ext(bf.Path) != ".so" {
+			binFile = bf.Path
+		}
+		if runtime.GOOS == "windows" {
+			continue
+		}
+		path := filepath.Join(tempDir, filepath.FromSlash(bf.Path))
+		info, err := os.Lstat(path)
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode().IsRegular() {
+			err = os.Chmod(path, info.Mode().Perm()|0111)
 			if err != nil {
-				return err
+				return nil, err
 			}
-
-			if !strings.HasPrefix(bf.Path, "__resources") {
-				ext := filepath.Ext(bf.Path)
-				if ext != ".so" {
-					binFile = bf.Path
-				}
-
-				if runtime.GOOS != "windows" {
-					cmd := exec.Command("chmod", "+x", path)
-					cmd.Dir = tempDir
-					err = cmd.Run()
-					if err != nil {
-						return err
-					}
-				}
-			} else {
-				hasResource = true
-			}
-			return nil
-		}(v)
-		if err != nil {
-			return err
 		}
 	}
 
@@ -126,7 +157,7 @@ func RunBinary(ctx context.Context, BinaryFiles []*common.BinaryFile, inChan io.
 		if !nodeMarker[i] {
 			err := os.MkdirAll(fmt.Sprintf(`%s/%s`, tempDir, v), os.ModeDir)
 			if err != nil {
-				return err
+				return nil, err
 			}
 		}
 	}
@@ -134,84 +165,164 @@ func RunBinary(ctx context.Context, BinaryFiles []*common.BinaryFile, inChan io.
 	if !hasResource {
 		err := os.MkdirAll(fmt.Sprintf(`%s/__resources`, tempDir), os.ModeDir)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
+	err = os.MkdirAll(fmt.Sprintf(`%s/tmp`, tempDir), 0755)
+	if err != nil {
+		return nil, err
+	}
 
 	runbin := tempDir + "/" + binFile
-	Args := []string{}
-	cmd := exec.CommandContext(ctx, runbin, Args...)
+	cmd := exec.CommandContext(ctx, runbin, opts.Args...)
 	cmd.Dir = tempDir + "/__resources"
 
-	envs := make([]string, 0)
-	for _, v := range os.Environ() {
-		envs = append(envs, v)
-	}
-	cmd.Env = envs
+	cmd.Env = runEnv(tempDir, opts.Env)
 
-	cmd.Stdin = inChan
 	cmd.Stdout = outChan
 	cmd.Stderr = errChan
+	cmd.WaitDelay = gWaitDelay
 
+	// without a cgroup the program runs anyway, the result tells the limits were not applied
+	var cg *sandbox.Cgroup
+	var limitsErr error
+	if !opts.Limits.IsZero() {
+		if len(opts.CgroupRoot) == 0 {
+			limitsErr = sandbox.ErrNoCgroup
+		} else if cg, limitsErr = sandbox.NewCgroup(opts.CgroupRoot, filepath.Base(tempDir), &opts.Limits); limitsErr == nil {
+			// also kills what the program left running
+			defer cg.Close()
+			cg.Apply(cmd)
+		}
+	}
+
+	// stdin is copied apart, Wait would wait for inChan to be closed otherwise
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
 	err = cmd.Start()
 	if err != nil {
-		return err
-	}
-
-	if runtime.GOOS != "windows" {
-		go func() error {
-			for {
-				time.Sleep(time.Second * 3)
-				grep, err := exec.Command("/bin/sh", "-c", fmt.Sprintf(`ls -l /proc/%d/fd | grep socket`, cmd.Process.Pid)).CombinedOutput()
-				if err != nil {
-					if !strings.Contains(err.Error(), "exit status") {
-						continue
-					}
-				}
-
-				ls := strings.Split(string(grep), "\n")
-				ports := make([]int64, 0, len(ls))
-				for _, v := range ls {
-					idx := strings.Index(v, "socket:[")
-					if idx >= 0 {
-						inode := v[idx+8 : len(v)-1]
-
-						cat, err := exec.Command("/bin/sh", "-c", fmt.Sprintf(`cat /proc/net/tcp6 | grep %s`, inode)).CombinedOutput()
-						if err != nil {
-							if !strings.Contains(err.Error(), "exit status") {
-								continue
-							}
-						}
-						if len(cat) > 0 {
-							vs := strings.Split(strings.TrimSpace(string(cat)), " ")
-							if len(vs) > 1 {
-								ps := strings.Split(vs[1], ":")
-								if len(ps) > 1 {
-									phex := ps[1]
-									port, err := strconv.ParseInt(phex, 16, 32)
-									if err != nil {
-										continue
-									}
-									ports = append(ports, port)
-								}
-							}
-						}
-					}
-				}
-				//UpdatePortMapper(ports)
-				sports := make([]string, 0, len(ports))
-				for _, v := range ports {
-					port := strconv.Itoa(int(v))
-					sports = append(sports, port)
-				}
-				portChan.Write([]byte(strings.Join(sports, ",")))
+		return nil, err
+	}
+	go func() {
+		io.Copy(stdin, inChan)
+		stdin.Close()
+	}()
+
+	exited := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		watchPorts(cmd.Process.Pid, opts.portInterval(), portChan, exited)
+	}()
+
+	err = cmd.Wait()
+	close(exited)
+	<-watched
+	state := cmd.ProcessState
+	if state == nil {
+		return nil, err
+	}
+
+	result := &common.RunResult{
+		ExitCode: state.ExitCode(),
+		Duration: time.Since(start),
+	}
+	if cg != nil {
+		result.Usage = cg.Usage()
+		if verr := cg.Violation(); verr != nil {
+			result.Reason = verr.Error()
+		}
+	}
+	if limitsErr != nil {
+		result.LimitsError = limitsErr.Error()
+	}
+	if Signal, signo := exitSignal(state); signo > 0 {
+		// exit like a shell does for a killed process
+		result.ExitCode = 128 + signo
+		result.Signal = Signal
+	}
+	return result, nil
+}
+
+// watchPorts polls the listening ports of the program and writes a PortEvent
+// for each port opened or closed, and closes them all when the program exits.
+func watchPorts(pid int, interval time.Duration, portChan io.Writer, exited chan struct{}) {
+	enc := json.NewEncoder(portChan)
+	send := func(Action string, lp *common.ListenPort) {
+		enc.Encode(&common.PortEvent{
+			Time:   time.Now(),
+			Action: Action,
+			Port:   lp,
+		})
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	ports := make([]*common.ListenPort, 0)
+	for {
+		select {
+		case <-exited:
+			for _, lp := range ports {
+				send("closed", lp)
+			}
+			return
+		case <-ticker.C:
+		}
+
+		current, err := ListenPorts(pid)
+		if err == ErrNotSupportPorts {
+			<-exited
+			return
+		}
+		if err != nil {
+			continue
+		}
+
+		currentHash := make(map[string]bool)
+		for _, lp := range current {
+			currentHash[lp.String()] = true
+		}
+		portHash := make(map[string]bool)
+		for _, lp := range ports {
+			portHash[lp.String()] = true
+			if !currentHash[lp.String()] {
+				send("closed", lp)
 			}
-		}()
+		}
+		for _, lp := range current {
+			if !portHash[lp.String()] {
+				send("opened", lp)
+			}
+		}
+		ports = current
 	}
+}
 
-	_, err = cmd.Process.Wait()
-	if err != nil {
-		return err
+func (opts *Options) portInterval() time.Duration {
+	if opts.PortInterval <= 0 {
+		return gPortInterval
+	}
+	if opts.PortInterval < gMinPortInterval {
+		return gMinPortInterval
+	}
+	return opts.PortInterval
+}
+
+func runEnv(tempDir string, Env []string) []string {
+	envs := make([]string, 0, len(gPassEnvKeys)+2+len(Env))
+	for _, key := range gPassEnvKeys {
+		if v, has := os.LookupEnv(key); has {
+			envs = append(envs, key+"="+v)
+		}
 	}
-	return nil
+	envs = append(envs,
+		"HOME="+tempDir,
+		"TMPDIR="+tempDir+"/tmp",
+	)
+	return append(envs, Env...)
 }
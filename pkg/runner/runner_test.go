@@ -0,0 +1,50 @@
+package runner
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blackss2/devfarm/common"
+)
+
+func binaryFile(Path string, Mode os.FileMode, data string) *common.BinaryFile {
+	return &common.BinaryFile{
+		Path:       Path,
+		Mode:       Mode,
+		ReadCloser: ioutil.NopCloser(strings.NewReader(data)),
+	}
+}
+
+func TestRunBinarySymlinkEscape(t *testing.T) {
+	secret, err := ioutil.TempFile("", "devfarm_secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret.Close()
+	defer os.Remove(secret.Name())
+	err = os.Chmod(secret.Name(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every link is relative and looks confined alone, the chain leads to the temp dir of the host
+	_, err = RunBinary(context.Background(), []*common.BinaryFile{
+		binaryFile("__resources/a/b/c", os.ModeSymlink|0777, "../../.."),
+		binaryFile("__resources/p", os.ModeSymlink|0777, "a/b/c/.."),
+		binaryFile("bin/x", os.ModeSymlink|0777, "../__resources/p/"+filepath.Base(secret.Name())),
+	}, nil, nil, nil, nil, nil)
+	if err == nil {
+		t.Fatal("ran a binary linked out of the work dir")
+	}
+	info, err := os.Stat(secret.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("mode of the host file = %v", info.Mode())
+	}
+}
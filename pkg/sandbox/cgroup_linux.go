@@ -0,0 +1,207 @@
+package sandbox
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/blackss2/devfarm/common"
+)
+
+const (
+	cpuPeriod = 100000
+	sysBlock  = "/sys/block"
+)
+
+var controllers = []string{"memory", "pids", "cpu", "io"}
+
+type Cgroup struct {
+	dir string
+	fd  int
+}
+
+// CgroupAvailable tells if this process can create cgroups: as root with cgroup v2 mounted.
+func CgroupAvailable() bool {
+	if os.Geteuid() != 0 {
+		return false
+	}
+	_, err := os.Stat("/sys/fs/cgroup/cgroup.controllers")
+	return err == nil
+}
+
+func NewCgroup(Root string, Name string, limits *Limits) (*Cgroup, error) {
+	err := os.MkdirAll(Root, 0755)
+	if err != nil {
+		return nil, err
+	}
+	// controllers have to be enabled by the parent for the children to have the interface files,
+	// one by one as a write fails as a whole for a controller the kernel doesn't have
+	for _, v := range controllers {
+		ioutil.WriteFile(filepath.Join(Root, "cgroup.subtree_control"), []byte("+"+v), 0644)
+	}
+
+	dir := filepath.Join(Root, Name)
+	err = os.Mkdir(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	cg := &Cgroup{
+		dir: dir,
+		fd:  -1,
+	}
+
+	if limits.MemoryMax > 0 {
+		if err := cg.write("memory.max", strconv.FormatInt(limits.MemoryMax, 10)); err != nil {
+			cg.Close()
+			return nil, err
+		}
+		cg.write("memory.swap.max", "0")
+	}
+	if limits.PidsMax > 0 {
+		if err := cg.write("pids.max", strconv.FormatInt(limits.PidsMax, 10)); err != nil {
+			cg.Close()
+			return nil, err
+		}
+	}
+	if limits.CPUs > 0 {
+		if err := cg.write("cpu.max", fmt.Sprintf("%d %d", int64(limits.CPUs*cpuPeriod), cpuPeriod)); err != nil {
+			cg.Close()
+			return nil, err
+		}
+	}
+
+	if limits.WriteBps > 0 {
+		if err := cg.limitWrite(limits.WriteBps); err != nil {
+			cg.Close()
+			return nil, err
+		}
+	}
+
+	cg.fd, err = syscall.Open(dir, syscall.O_DIRECTORY|syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		cg.Close()
+		return nil, err
+	}
+	return cg, nil
+}
+
+func (cg *Cgroup) Dir() string {
+	return cg.dir
+}
+
+func (cg *Cgroup) FD() int {
+	return cg.fd
+}
+
+// Apply makes cmd start in the cgroup.
+func (cg *Cgroup) Apply(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = cg.fd
+}
+
+// Usage returns the peak usage of the cgroup, the fields the kernel doesn't provide are zero.
+func (cg *Cgroup) Usage() *common.ResourceUsage {
+	usage := &common.ResourceUsage{}
+	if data, err := ioutil.ReadFile(filepath.Join(cg.dir, "memory.peak")); err == nil {
+		usage.MemoryPeak, _ = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(cg.dir, "pids.peak")); err == nil {
+		usage.PidsPeak, _ = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	}
+	cpu := cg.Events("cpu.stat")
+	usage.CPUTime = time.Duration(cpu["usage_usec"]) * time.Microsecond
+	usage.CPUThrottled = time.Duration(cpu["throttled_usec"]) * time.Microsecond
+
+	// MAJ:MIN rbytes=N wbytes=N rios=N wios=N ...
+	if data, err := ioutil.ReadFile(filepath.Join(cg.dir, "io.stat")); err == nil {
+		for _, field := range strings.Fields(string(data)) {
+			if strings.HasPrefix(field, "wbytes=") {
+				n, _ := strconv.ParseInt(field[len("wbytes="):], 10, 64)
+				usage.WriteBytes += n
+			}
+		}
+	}
+	return usage
+}
+
+func (cg *Cgroup) Events(Name string) map[string]int64 {
+	events := make(map[string]int64)
+	file, err := os.Open(filepath.Join(cg.dir, Name))
+	if err != nil {
+		return events
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		n, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		events[fields[0]] = n
+	}
+	return events
+}
+
+func (cg *Cgroup) Violation() error {
+	if cg.Events("memory.events")["oom_kill"] > 0 {
+		return ErrMemoryLimit
+	}
+	if cg.Events("pids.events")["max"] > 0 {
+		return ErrPidsLimit
+	}
+	return nil
+}
+
+func (cg *Cgroup) Close() error {
+	if cg.fd >= 0 {
+		syscall.Close(cg.fd)
+		cg.fd = -1
+	}
+	cg.write("cgroup.kill", "1")
+
+	var err error
+	for i := 0; i < 50; i++ {
+		err = os.Remove(cg.dir)
+		if err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return err
+}
+
+// limitWrite throttles writes on every block device, io.max has no limit for all devices.
+func (cg *Cgroup) limitWrite(Bps int64) error {
+	devices, err := ioutil.ReadDir(sysBlock)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		data, err := ioutil.ReadFile(filepath.Join(sysBlock, device.Name(), "dev"))
+		if err != nil {
+			continue
+		}
+		// devices without io support reject it
+		cg.write("io.max", fmt.Sprintf("%s wbps=%d", strings.TrimSpace(string(data)), Bps))
+	}
+	return nil
+}
+
+func (cg *Cgroup) write(Name string, value string) error {
+	return ioutil.WriteFile(filepath.Join(cg.dir, Name), []byte(value), 0644)
+}
@@ -0,0 +1,34 @@
+//go:build !linux
+
+package sandbox
+
+import (
+	"os/exec"
+
+	"github.com/blackss2/devfarm/common"
+)
+
+type Cgroup struct{}
+
+func CgroupAvailable() bool {
+	return false
+}
+
+func NewCgroup(Root string, Name string, limits *Limits) (*Cgroup, error) {
+	return nil, ErrNotSupported
+}
+
+func (cg *Cgroup) Apply(cmd *exec.Cmd) {
+}
+
+func (cg *Cgroup) Usage() *common.ResourceUsage {
+	return nil
+}
+
+func (cg *Cgroup) Violation() error {
+	return nil
+}
+
+func (cg *Cgroup) Close() error {
+	return nil
+}
@@ -0,0 +1,107 @@
+package sandbox
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotSupported = errors.New("sandbox is not supported on this platform")
+	ErrMemoryLimit  = errors.New("memory limit exceeded")
+	ErrPidsLimit    = errors.New("pids limit exceeded")
+	ErrTimeout      = errors.New("time limit exceeded")
+	ErrNoFreeUid    = errors.New("no free sandbox uid")
+	ErrNoCgroup     = errors.New("cgroup v2 is not available")
+	ErrInvalidInit  = errors.New("invalid sandbox init arguments")
+)
+
+type Limits struct {
+	MemoryMax int64   `json:"memory_max,omitempty"`
+	CPUs      float64 `json:"cpus,omitempty"`
+	PidsMax   int64   `json:"pids_max,omitempty"`
+	WriteBps  int64   `json:"write_bps,omitempty"`
+}
+
+func (l *Limits) IsZero() bool {
+	return l == nil || (l.MemoryMax <= 0 && l.CPUs <= 0 && l.PidsMax <= 0 && l.WriteBps <= 0)
+}
+
+type Config struct {
+	// Uid and Gid start a range of Uids ids; sandboxes of one owner share an id, others never do at the same time
+	Uid        int
+	Gid        int
+	Uids       int
+	Network    bool
+	Limits     Limits
+	Timeout    time.Duration
+	CgroupRoot string
+}
+
+type uidLease struct {
+	offset int
+	count  int
+}
+
+type uidPool struct {
+	sync.Mutex
+	leaseHash  map[string]*uidLease
+	offsetHash map[int]string
+}
+
+var gUidPool = &uidPool{
+	leaseHash:  make(map[string]*uidLease),
+	offsetHash: make(map[int]string),
+}
+
+// acquire keeps the offset of an owner stable while it's free, so its files rarely need a chown
+func (up *uidPool) acquire(Owner string, Size int) (int, error) {
+	if Size <= 1 {
+		return 0, nil
+	}
+	up.Lock()
+	defer up.Unlock()
+
+	if lease, has := up.leaseHash[Owner]; has {
+		lease.count++
+		return lease.offset, nil
+	}
+	h := fnv.New32a()
+	h.Write([]byte(Owner))
+	start := int(h.Sum32() % uint32(Size))
+	for i := 0; i < Size; i++ {
+		offset := (start + i) % Size
+		if _, has := up.offsetHash[offset]; has {
+			continue
+		}
+		up.leaseHash[Owner] = &uidLease{
+			offset: offset,
+			count:  1,
+		}
+		up.offsetHash[offset] = Owner
+		return offset, nil
+	}
+	return 0, ErrNoFreeUid
+}
+
+// release calls free with the pool locked when the last sandbox of the owner is gone, before another owner can get its uid
+func (up *uidPool) release(Owner string, Size int, free func()) {
+	if Size <= 1 {
+		return
+	}
+	up.Lock()
+	defer up.Unlock()
+
+	lease, has := up.leaseHash[Owner]
+	if !has {
+		return
+	}
+	lease.count--
+	if lease.count > 0 {
+		return
+	}
+	free()
+	delete(up.leaseHash, Owner)
+	delete(up.offsetHash, lease.offset)
+}
@@ -0,0 +1,245 @@
+package sandbox
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+const (
+	initArg = "devfarm-sandbox-init"
+)
+
+var (
+	// shared writable dirs get an empty tmpfs in the sandbox; the dirs given to Apply are mounted back
+	gPrivateDirs = []string{"/tmp", "/var/tmp", "/dev/shm"}
+)
+
+type Sandbox struct {
+	config *Config
+	cgroup *Cgroup
+	parent context.Context
+	ctx    context.Context
+	cancel context.CancelFunc
+	owner  string
+	uid    int
+	gid    int
+	dirs   []string
+}
+
+// New starts a sandbox; sandboxes with the same Owner (a go cache they both write) run as the same uid
+func New(ctx context.Context, config *Config, Name string, Owner string) (*Sandbox, context.Context, error) {
+	offset, err := gUidPool.acquire(Owner, config.Uids)
+	if err != nil {
+		return nil, nil, err
+	}
+	sb := &Sandbox{
+		config: config,
+		parent: ctx,
+		owner:  Owner,
+		uid:    config.Uid + offset,
+		gid:    config.Gid + offset,
+	}
+	if config.Timeout > 0 {
+		sb.ctx, sb.cancel = context.WithTimeout(ctx, config.Timeout)
+	} else {
+		sb.ctx, sb.cancel = context.WithCancel(ctx)
+	}
+
+	if !config.Limits.IsZero() {
+		cg, err := NewCgroup(config.CgroupRoot, Name, &config.Limits)
+		if err != nil {
+			sb.cancel()
+			sb.releaseUid()
+			return nil, nil, err
+		}
+		sb.cgroup = cg
+	}
+	return sb, sb.ctx, nil
+}
+
+// Apply runs cmd through the sandbox init, which gives it private mounts where only Dirs are writable
+func (sb *Sandbox) Apply(cmd *exec.Cmd, Dirs ...string) error {
+	for _, dir := range Dirs {
+		err := chownTree(dir, sb.uid, sb.gid)
+		if err != nil {
+			return err
+		}
+		err = os.Chmod(dir, 0700)
+		if err != nil {
+			return err
+		}
+	}
+	sb.dirs = append(sb.dirs, Dirs...)
+
+	args := []string{initArg, strconv.Itoa(sb.uid), strconv.Itoa(sb.gid), strconv.Itoa(len(Dirs))}
+	args = append(args, Dirs...)
+	args = append(args, cmd.Path)
+	args = append(args, cmd.Args...)
+	cmd.Path = "/proc/self/exe"
+	cmd.Args = args
+
+	flags := uintptr(syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS)
+	if !sb.config.Network {
+		flags |= syscall.CLONE_NEWNET
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: flags,
+		Pdeathsig:  syscall.SIGKILL,
+	}
+	if sb.cgroup != nil {
+		sb.cgroup.Apply(cmd)
+	}
+	return nil
+}
+
+func (sb *Sandbox) Violation() error {
+	if sb.cgroup != nil {
+		if err := sb.cgroup.Violation(); err != nil {
+			return err
+		}
+	}
+	if sb.ctx.Err() == context.DeadlineExceeded && sb.parent.Err() == nil {
+		return ErrTimeout
+	}
+	return nil
+}
+
+func (sb *Sandbox) Close() error {
+	sb.cancel()
+	sb.releaseUid()
+	if sb.cgroup != nil {
+		return sb.cgroup.Close()
+	}
+	return nil
+}
+
+// releaseUid gives the dirs back to root, so the next owner of the uid can't open them
+func (sb *Sandbox) releaseUid() {
+	gUidPool.release(sb.owner, sb.config.Uids, func() {
+		for _, dir := range sb.dirs {
+			os.Lchown(dir, 0, 0)
+		}
+	})
+}
+
+// Init runs the sandbox init when the server is started by Apply and never returns then; call it first in main
+func Init() {
+	if len(os.Args) < 2 || os.Args[0] != initArg {
+		return
+	}
+	err := runInit(os.Args[1:])
+	fmt.Fprintf(os.Stderr, "devfarm: sandbox: %v\n", err)
+	os.Exit(126)
+}
+
+func runInit(args []string) error {
+	if len(args) < 4 {
+		return ErrInvalidInit
+	}
+	Uid, err := strconv.Atoi(args[0])
+	if err != nil {
+		return ErrInvalidInit
+	}
+	Gid, err := strconv.Atoi(args[1])
+	if err != nil {
+		return ErrInvalidInit
+	}
+	n, err := strconv.Atoi(args[2])
+	if err != nil || n < 0 || len(args) < 3+n+2 {
+		return ErrInvalidInit
+	}
+	Dirs := args[3 : 3+n]
+	Path := args[3+n]
+	Args := args[3+n+1:]
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	err = syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return err
+	}
+
+	// keep the dirs open to mount them back over the tmpfs
+	fds := make([]int, 0, len(Dirs))
+	for _, dir := range Dirs {
+		fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		fds = append(fds, fd)
+	}
+	for _, dir := range gPrivateDirs {
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		err = syscall.Mount("tmpfs", dir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777")
+		if err != nil {
+			return err
+		}
+	}
+	for i, dir := range Dirs {
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+		err = syscall.Mount("/proc/self/fd/"+strconv.Itoa(fds[i]), dir, "", syscall.MS_BIND|syscall.MS_REC, "")
+		if err != nil {
+			return err
+		}
+		syscall.Close(fds[i])
+	}
+	err = syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+	if err != nil {
+		return err
+	}
+	err = os.Chdir(wd)
+	if err != nil {
+		return err
+	}
+
+	err = syscall.Setgroups([]int{})
+	if err != nil {
+		return err
+	}
+	err = syscall.Setgid(Gid)
+	if err != nil {
+		return err
+	}
+	err = syscall.Setuid(Uid)
+	if err != nil {
+		return err
+	}
+	// changing the credentials clears the parent death signal
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_PDEATHSIG, uintptr(syscall.SIGKILL), 0)
+	if errno != 0 {
+		return errno
+	}
+	return syscall.Exec(Path, Args, os.Environ())
+}
+
+func Env(HomeDir string) []string {
+	return []string{
+		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		"HOME=" + HomeDir,
+		"TMPDIR=" + filepath.Join(HomeDir, "tmp"),
+	}
+}
+
+func chownTree(dir string, Uid int, Gid int) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) == Uid && int(st.Gid) == Gid {
+			return nil
+		}
+		return os.Lchown(path, Uid, Gid)
+	})
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+
+package sandbox
+
+import (
+	"context"
+	"os/exec"
+)
+
+type Sandbox struct{}
+
+func New(ctx context.Context, config *Config, Name string, Owner string) (*Sandbox, context.Context, error) {
+	return nil, nil, ErrNotSupported
+}
+
+func (sb *Sandbox) Apply(cmd *exec.Cmd, Dirs ...string) error {
+	return ErrNotSupported
+}
+
+func (sb *Sandbox) Violation() error {
+	return nil
+}
+
+func (sb *Sandbox) Close() error {
+	return nil
+}
+
+func Init() {
+}
+
+func Env(HomeDir string) []string {
+	return nil
+}
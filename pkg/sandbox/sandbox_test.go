@@ -0,0 +1,46 @@
+package sandbox
+
+import (
+	"testing"
+)
+
+func TestUidPool(t *testing.T) {
+	up := &uidPool{
+		leaseHash:  make(map[string]*uidLease),
+		offsetHash: make(map[int]string),
+	}
+	a, err := up.acquire("a", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := up.acquire("a", 2); err != nil || again != a {
+		t.Errorf("acquire(a) again = %d, %v, want %d", again, err, a)
+	}
+	b, err := up.acquire("b", 2)
+	if err != nil || b == a {
+		t.Errorf("acquire(b) = %d, %v, want other than %d", b, err, a)
+	}
+	if _, err := up.acquire("c", 2); err != ErrNoFreeUid {
+		t.Errorf("acquire(c) = %v, want ErrNoFreeUid", err)
+	}
+
+	freed := 0
+	free := func() {
+		freed++
+	}
+	up.release("a", 2, free)
+	if freed != 0 {
+		t.Errorf("released a shared uid")
+	}
+	up.release("a", 2, free)
+	if freed != 1 {
+		t.Errorf("freed = %d, want 1", freed)
+	}
+	if c, err := up.acquire("c", 2); err != nil || c != a {
+		t.Errorf("acquire(c) = %d, %v, want %d", c, err, a)
+	}
+
+	if offset, err := up.acquire("d", 1); err != nil || offset != 0 {
+		t.Errorf("acquire with a single uid = %d, %v", offset, err)
+	}
+}
@@ -0,0 +1,204 @@
+package toolchain
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrNotExistToolchain = errors.New("not exist toolchain")
+)
+
+type Toolchain struct {
+	Version string `json:"version"`
+	GoRoot  string `json:"goroot"`
+	Default bool   `json:"default,omitempty"`
+}
+
+type Registry struct {
+	sync.Mutex
+	dir           string
+	defaultGoRoot string
+	toolchains    []*Toolchain
+}
+
+func NewRegistry(dir string, DefaultGoRoot string) (*Registry, error) {
+	tr := &Registry{
+		dir:           dir,
+		defaultGoRoot: DefaultGoRoot,
+	}
+	err := tr.Scan()
+	if err != nil {
+		return nil, err
+	}
+	return tr, nil
+}
+
+func (tr *Registry) Scan() error {
+	toolchains := make([]*Toolchain, 0)
+	versionHash := make(map[string]bool)
+
+	if len(tr.defaultGoRoot) > 0 {
+		Version, err := GoRootVersion(tr.defaultGoRoot)
+		if err != nil {
+			return err
+		}
+		toolchains = append(toolchains, &Toolchain{
+			Version: Version,
+			GoRoot:  tr.defaultGoRoot,
+			Default: true,
+		})
+		versionHash[Version] = true
+	}
+
+	infos, err := ioutil.ReadDir(tr.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, info := range infos {
+		GoRoot := filepath.Join(tr.dir, info.Name())
+		if _, err := os.Stat(filepath.Join(GoRoot, "bin", "go")); err != nil {
+			continue
+		}
+		Version, err := GoRootVersion(GoRoot)
+		if err != nil || versionHash[Version] {
+			continue
+		}
+		toolchains = append(toolchains, &Toolchain{
+			Version: Version,
+			GoRoot:  GoRoot,
+		})
+		versionHash[Version] = true
+	}
+	sort.Slice(toolchains, func(i, j int) bool {
+		return compareVersion(toolchains[i].Version, toolchains[j].Version) > 0
+	})
+
+	tr.Lock()
+	tr.toolchains = toolchains
+	tr.Unlock()
+	return nil
+}
+
+func (tr *Registry) List() []*Toolchain {
+	tr.Lock()
+	defer tr.Unlock()
+
+	list := make([]*Toolchain, len(tr.toolchains))
+	copy(list, tr.toolchains)
+	return list
+}
+
+// Lookup accepts go1.21.5, 1.21.5 or 1.21 (the newest 1.21.x); an empty version is the default toolchain
+func (tr *Registry) Lookup(Version string) (*Toolchain, error) {
+	tr.Lock()
+	defer tr.Unlock()
+
+	if len(Version) == 0 {
+		for _, tc := range tr.toolchains {
+			if tc.Default {
+				return tc, nil
+			}
+		}
+		if len(tr.toolchains) > 0 {
+			return tr.toolchains[0], nil
+		}
+		return nil, ErrNotExistToolchain
+	}
+
+	if !strings.HasPrefix(Version, "go") {
+		Version = "go" + Version
+	}
+	for _, tc := range tr.toolchains {
+		if tc.Version == Version || strings.HasPrefix(tc.Version, Version+".") {
+			return tc, nil
+		}
+	}
+	return nil, ErrNotExistToolchain
+}
+
+func GoRootVersion(GoRoot string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(GoRoot, "VERSION"))
+	if err == nil {
+		lines := strings.SplitN(string(data), "\n", 2)
+		if Version := strings.TrimSpace(lines[0]); strings.HasPrefix(Version, "go") {
+			return Version, nil
+		}
+	}
+
+	cmd := exec.Command(filepath.Join(GoRoot, "bin", "go"), "env", "GOVERSION")
+	cmd.Env = append(os.Environ(), "GOROOT="+GoRoot, "GOTOOLCHAIN=local")
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func compareVersion(a string, b string) int {
+	as := versionParts(a)
+	bs := versionParts(b)
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	// go1.21rc1 comes before go1.21.0
+	ap := preRelease(a)
+	bp := preRelease(b)
+	if ap != bp {
+		if len(ap) == 0 {
+			return 1
+		}
+		if len(bp) == 0 {
+			return -1
+		}
+		if ap < bp {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+func preRelease(Version string) string {
+	Version = strings.TrimPrefix(Version, "go")
+	idx := strings.IndexFunc(Version, func(r rune) bool {
+		return r != '.' && (r < '0' || '9' < r)
+	})
+	if idx < 0 {
+		return ""
+	}
+	return Version[idx:]
+}
+
+func versionParts(Version string) []int {
+	Version = strings.TrimPrefix(Version, "go")
+	parts := make([]int, 0, 3)
+	for _, v := range strings.Split(Version, ".") {
+		end := 0
+		for end < len(v) && '0' <= v[end] && v[end] <= '9' {
+			end++
+		}
+		n, _ := strconv.Atoi(v[:end])
+		parts = append(parts, n)
+	}
+	return parts
+}
@@ -0,0 +1,73 @@
+package toolchain
+
+import (
+	"testing"
+)
+
+func TestCompareVersion(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		want int
+	}{
+		{"go1.21.5", "go1.21.5", 0},
+		{"go1.21.5", "go1.21.10", -1},
+		{"go1.22.0", "go1.21.10", 1},
+		{"go1.21", "go1.21.0", 0},
+		{"go1.9", "go1.10", -1},
+		{"go1.21rc1", "go1.21.0", -1},
+		{"go1.21.0", "go1.21rc2", 1},
+		{"go1.21beta1", "go1.21rc1", -1},
+		{"go1.21rc2", "go1.21rc1", 1},
+		{"go1.20.12", "go1.21rc1", -1},
+		{"1.21.5", "go1.21.5", 0},
+	}
+	for _, tt := range tests {
+		got := compareVersion(tt.a, tt.b)
+		if got != tt.want {
+			t.Errorf("compareVersion(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	tr := &Registry{
+		toolchains: []*Toolchain{
+			{Version: "go1.22.1", GoRoot: "/t/go1.22.1"},
+			{Version: "go1.21.10", GoRoot: "/t/go1.21.10"},
+			{Version: "go1.21.5", GoRoot: "/usr/local/go", Default: true},
+			{Version: "go1.2.2", GoRoot: "/t/go1.2.2"},
+		},
+	}
+	tests := []struct {
+		Version string
+		want    string
+	}{
+		{"", "go1.21.5"},
+		{"go1.21.5", "go1.21.5"},
+		{"1.21.5", "go1.21.5"},
+		{"1.21", "go1.21.10"},
+		{"go1.22", "go1.22.1"},
+		{"1.2", "go1.2.2"},
+		{"1", "go1.22.1"},
+		{"1.20", ""},
+		{"go1.21.6", ""},
+	}
+	for _, tt := range tests {
+		tc, err := tr.Lookup(tt.Version)
+		if len(tt.want) == 0 {
+			if err != ErrNotExistToolchain {
+				t.Errorf("Lookup(%q) = %v, %v, want ErrNotExistToolchain", tt.Version, tc, err)
+			}
+			continue
+		}
+		if err != nil || tc.Version != tt.want {
+			t.Errorf("Lookup(%q) = %v, %v, want %s", tt.Version, tc, err, tt.want)
+		}
+	}
+
+	empty := &Registry{}
+	if _, err := empty.Lookup(""); err != ErrNotExistToolchain {
+		t.Errorf("Lookup on an empty registry = %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package uploader
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/blackss2/devfarm/common"
+	"github.com/blackss2/devfarm/utils"
+)
+
+var (
+	ErrEmptyId = errors.New("empty id")
+)
+
+func UploadBlobs(HostAddr string, fl *utils.FileList) (*common.UploadManifest, error) {
+	um := &common.UploadManifest{
+		Files: make(map[string]string),
+		Modes: make(map[string]os.FileMode),
+	}
+	entryHash := make(map[string]*utils.FileEntry)
+	hashes := make([]string, 0, len(fl.Entries))
+	for _, fe := range fl.Entries {
+		hash, err := fe.Hash()
+		if err != nil {
+			return nil, err
+		}
+		um.Files[fe.Path] = hash
+		if mode := utils.NormalizeMode(fe.Mode); mode != 0644 {
+			um.Modes[fe.Path] = mode
+		}
+		if _, has := entryHash[hash]; !has {
+			entryHash[hash] = fe
+			hashes = append(hashes, hash)
+		}
+	}
+
+	data, err := json.Marshal(hashes)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.Post("http://"+HostAddr+"/api/blobs/missing", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return nil, errors.New(string(body))
+	}
+
+	var missing []string
+	err = json.NewDecoder(res.Body).Decode(&missing)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, hash := range missing {
+		fe, has := entryHash[hash]
+		if !has {
+			continue
+		}
+		err := UploadBlob(HostAddr, hash, fe)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return um, nil
+}
+
+func UploadBlob(HostAddr string, hash string, fe *utils.FileEntry) error {
+	r, err := fe.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	req, err := http.NewRequest("PUT", "http://"+HostAddr+"/api/blobs/"+hash, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != 200 {
+		return errors.New(string(body))
+	}
+	return nil
+}
+
+func CreateSpace(HostAddr string, um *common.UploadManifest) (string, error) {
+	data, err := json.Marshal(um)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := http.Post("http://"+HostAddr+"/api/spaces", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != 200 {
+		return "", errors.New(string(body))
+	}
+
+	Id := string(body)
+	if len(Id) == 0 {
+		return "", ErrEmptyId
+	}
+	return Id, nil
+}
+
+func RunMatrix(HostAddr string, req *common.MatrixRequest) (*common.MatrixReport, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := http.Post("http://"+HostAddr+"/api/matrix", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return nil, errors.New(string(body))
+	}
+
+	var report common.MatrixReport
+	err = json.NewDecoder(res.Body).Decode(&report)
+	if err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
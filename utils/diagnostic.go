@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/blackss2/devfarm/common"
+)
+
+var diagnosticRegexp = regexp.MustCompile(`^((?:[A-Za-z]:)?[^:\s][^:]*\.(?:go|s|c|h|cc|cpp|m|mod|work)):(\d+)(?::(\d+))?: (.*)$`)
+
+func ParseDiagnostic(line string) (*common.Diagnostic, bool) {
+	ms := diagnosticRegexp.FindStringSubmatch(line)
+	if ms == nil {
+		return nil, false
+	}
+	d := &common.Diagnostic{
+		File:    ms[1],
+		Message: ms[4],
+	}
+	d.Line, _ = strconv.Atoi(ms[2])
+	if len(ms[3]) > 0 {
+		d.Column, _ = strconv.Atoi(ms[3])
+	}
+	return d, true
+}
+
+func FormatDiagnostic(d *common.Diagnostic) string {
+	if d.Column > 0 {
+		return fmt.Sprintf("%s:%d:%d: %s", d.File, d.Line, d.Column, d.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", d.File, d.Line, d.Message)
+}
+
+func RewriteDiagnostics(Log string, rewrite func(File string) string) (string, []*common.Diagnostic) {
+	Diagnostics := make([]*common.Diagnostic, 0)
+	lines := strings.Split(Log, "\n")
+	for i, line := range lines {
+		d, ok := ParseDiagnostic(line)
+		if !ok {
+			continue
+		}
+		d.File = rewrite(d.File)
+		lines[i] = FormatDiagnostic(d)
+		Diagnostics = append(Diagnostics, d)
+	}
+	return strings.Join(lines, "\n"), Diagnostics
+}
@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/blackss2/devfarm/common"
+)
+
+func TestParseDiagnostic(t *testing.T) {
+	tests := []struct {
+		line string
+		want *common.Diagnostic
+	}{
+		{"./main.go:12:5: undefined: foo", &common.Diagnostic{File: "./main.go", Line: 12, Column: 5, Message: "undefined: foo"}},
+		{"/tmp/devfarm_builder1/src/x/a.go:3: syntax error", &common.Diagnostic{File: "/tmp/devfarm_builder1/src/x/a.go", Line: 3, Message: "syntax error"}},
+		{"C:/work/x/a.go:7:1: missing return", &common.Diagnostic{File: "C:/work/x/a.go", Line: 7, Column: 1, Message: "missing return"}},
+		{"go.mod:4: unknown directive: foo", &common.Diagnostic{File: "go.mod", Line: 4, Message: "unknown directive: foo"}},
+		{"src/x/asm_amd64.s:10: unexpected EOF", &common.Diagnostic{File: "src/x/asm_amd64.s", Line: 10, Message: "unexpected EOF"}},
+		{"vet: x.go:3:1: a: b", nil},
+		{"# example.com/x", nil},
+		{"ok  \texample.com/x\t0.01s", nil},
+		{"main.txt:1: not a source file", nil},
+		{"main.go:x: not a line", nil},
+		{"main.go:12:5:no space", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		got, ok := ParseDiagnostic(tt.line)
+		if ok != (tt.want != nil) || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseDiagnostic(%q) = %+v, %v, want %+v", tt.line, got, ok, tt.want)
+		}
+	}
+}
+
+func TestRewriteDiagnostics(t *testing.T) {
+	Log := "# example.com/x\nsrc/example.com/x/main.go:3:2: undefined: y\n"
+	rewrite := func(File string) string {
+		return "main.go"
+	}
+	got, Diagnostics := RewriteDiagnostics(Log, rewrite)
+	if want := "# example.com/x\nmain.go:3:2: undefined: y\n"; got != want {
+		t.Errorf("RewriteDiagnostics log = %q, want %q", got, want)
+	}
+	want := []*common.Diagnostic{{File: "main.go", Line: 3, Column: 2, Message: "undefined: y"}}
+	if !reflect.DeepEqual(Diagnostics, want) {
+		t.Errorf("RewriteDiagnostics diagnostics = %+v, want %+v", Diagnostics, want)
+	}
+}
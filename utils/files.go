@@ -0,0 +1,179 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+type FileEntry struct {
+	Path       string
+	LocalPath  string
+	Data       []byte
+	Mode       os.FileMode
+	LinkTarget string
+	hash       string
+}
+
+func (fe *FileEntry) Open() (io.ReadCloser, error) {
+	if fe.IsSymlink() {
+		return ioutil.NopCloser(bytes.NewReader([]byte(fe.LinkTarget))), nil
+	}
+	if len(fe.LocalPath) == 0 {
+		return ioutil.NopCloser(bytes.NewReader(fe.Data)), nil
+	}
+	return os.Open(fe.LocalPath)
+}
+
+func (fe *FileEntry) IsSymlink() bool {
+	return fe.Mode&os.ModeSymlink != 0
+}
+
+func (fe *FileEntry) Hash() (string, error) {
+	if len(fe.hash) > 0 {
+		return fe.hash, nil
+	}
+
+	r, err := fe.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+	fe.hash = hex.EncodeToString(h.Sum(nil))
+	return fe.hash, nil
+}
+
+type FileList struct {
+	Entries []*FileEntry
+}
+
+func (fl *FileList) AddDir(localPath string, prefix string, ig *Ignorer) error {
+	if len(prefix) > 0 {
+		prefix = prefix + "/"
+	}
+	prefix = filepath.ToSlash(prefix)
+	err := filepath.Walk(localPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localPath, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel != "." && ig.Match(path, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return ig.LoadDir(path)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fl.AddSymlink(target, prefix+rel)
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		fl.Entries = append(fl.Entries, &FileEntry{
+			Path:      prefix + rel,
+			LocalPath: path,
+			Mode:      NormalizeMode(info.Mode()),
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (fl *FileList) AddFile(localPath string, name string) {
+	fl.Entries = append(fl.Entries, &FileEntry{
+		Path:      filepath.ToSlash(name),
+		LocalPath: localPath,
+		Mode:      0644,
+	})
+}
+
+func (fl *FileList) AddData(name string, data []byte) {
+	fl.Entries = append(fl.Entries, &FileEntry{
+		Path: filepath.ToSlash(name),
+		Data: data,
+		Mode: 0644,
+	})
+}
+
+func (fl *FileList) AddSymlink(target string, name string) {
+	fl.Entries = append(fl.Entries, &FileEntry{
+		Path:       filepath.ToSlash(name),
+		Mode:       os.ModeSymlink | 0777,
+		LinkTarget: filepath.ToSlash(target),
+	})
+}
+
+func (fl *FileList) Sort() {
+	sort.SliceStable(fl.Entries, func(i, j int) bool {
+		return fl.Entries[i].Path < fl.Entries[j].Path
+	})
+}
+
+func (fl *FileList) Digest() (string, error) {
+	files := make(map[string]string)
+	modes := make(map[string]os.FileMode)
+	for _, fe := range fl.Entries {
+		hash, err := fe.Hash()
+		if err != nil {
+			return "", err
+		}
+		files[fe.Path] = hash
+		modes[fe.Path] = fe.Mode
+	}
+	return DigestFiles(files, modes), nil
+}
+
+func DigestFiles(files map[string]string, modes map[string]os.FileMode) string {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	h := sha256.New()
+	for _, path := range paths {
+		mode, has := modes[path]
+		if !has {
+			mode = 0644
+		}
+		fmt.Fprintf(h, "%o %s %s\n", uint32(NormalizeMode(mode)), files[path], path)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func NormalizeMode(mode os.FileMode) os.FileMode {
+	if mode&os.ModeSymlink != 0 {
+		return os.ModeSymlink | 0777
+	}
+	if mode&0111 != 0 {
+		return 0755
+	}
+	return 0644
+}
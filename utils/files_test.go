@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDigestFiles(t *testing.T) {
+	files := map[string]string{
+		"src/a/main.go": "aa",
+		"src/a/run.sh":  "bb",
+	}
+	base := DigestFiles(files, map[string]os.FileMode{"src/a/run.sh": 0755})
+
+	tests := []struct {
+		name  string
+		files map[string]string
+		modes map[string]os.FileMode
+		same  bool
+	}{
+		{"same content", map[string]string{"src/a/run.sh": "bb", "src/a/main.go": "aa"}, map[string]os.FileMode{"src/a/run.sh": 0755}, true},
+		{"normalized mode", files, map[string]os.FileMode{"src/a/main.go": 0600, "src/a/run.sh": 0700}, true},
+		{"mode changed", files, nil, false},
+		{"hash changed", map[string]string{"src/a/main.go": "ab", "src/a/run.sh": "bb"}, map[string]os.FileMode{"src/a/run.sh": 0755}, false},
+		{"path changed", map[string]string{"src/b/main.go": "aa", "src/a/run.sh": "bb"}, map[string]os.FileMode{"src/a/run.sh": 0755}, false},
+		{"file added", map[string]string{"src/a/main.go": "aa", "src/a/run.sh": "bb", "src/a/x.go": "cc"}, map[string]os.FileMode{"src/a/run.sh": 0755}, false},
+	}
+	for _, tt := range tests {
+		got := DigestFiles(tt.files, tt.modes)
+		if (got == base) != tt.same {
+			t.Errorf("%s: digest equal = %v, want %v", tt.name, got == base, tt.same)
+		}
+	}
+}
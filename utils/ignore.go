@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	IgnoreFileName    = ".devfarmignore"
+	GitIgnoreFileName = ".gitignore"
+)
+
+type ignoreRule struct {
+	base     string
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+type Ignorer struct {
+	fileNames []string
+	rules     []*ignoreRule
+	loadHash  map[string]bool
+}
+
+func NewIgnorer(FileNames ...string) *Ignorer {
+	ig := &Ignorer{
+		fileNames: FileNames,
+		rules:     make([]*ignoreRule, 0),
+		loadHash:  make(map[string]bool),
+	}
+	return ig
+}
+
+func (ig *Ignorer) AddPatterns(dir string, Lines []string) {
+	base := filepath.ToSlash(filepath.Clean(dir))
+	for _, line := range Lines {
+		rule := parseIgnoreLine(line)
+		if rule == nil {
+			continue
+		}
+		rule.base = base
+		ig.rules = append(ig.rules, rule)
+	}
+}
+
+func (ig *Ignorer) LoadDir(dir string) error {
+	if ig == nil {
+		return nil
+	}
+	dir = filepath.Clean(dir)
+	if ig.loadHash[dir] {
+		return nil
+	}
+	ig.loadHash[dir] = true
+
+	for _, name := range ig.fileNames {
+		file, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		Lines := make([]string, 0)
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			Lines = append(Lines, scanner.Text())
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		ig.AddPatterns(dir, Lines)
+	}
+	return nil
+}
+
+func (ig *Ignorer) LoadParents(rootDir string, dir string) error {
+	if ig == nil {
+		return nil
+	}
+	rel, err := filepath.Rel(rootDir, dir)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return nil
+	}
+	cur := filepath.Clean(rootDir)
+	if rel == "." {
+		return nil
+	}
+	for _, v := range strings.Split(rel, string(filepath.Separator)) {
+		err := ig.LoadDir(cur)
+		if err != nil {
+			return err
+		}
+		cur = filepath.Join(cur, v)
+	}
+	return nil
+}
+
+func (ig *Ignorer) Match(localPath string, isDir bool) bool {
+	if ig == nil {
+		return false
+	}
+	localPath = filepath.ToSlash(filepath.Clean(localPath))
+
+	ignored := false
+	for _, rule := range ig.rules {
+		if !strings.HasPrefix(localPath, rule.base+"/") {
+			continue
+		}
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		rel := localPath[len(rule.base)+1:]
+		if rule.match(rel) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+func parseIgnoreLine(line string) *ignoreRule {
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if len(line) == 0 || line[0] == '#' {
+		return nil
+	}
+
+	rule := &ignoreRule{}
+	if line[0] == '!' {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if len(line) == 0 {
+		return nil
+	}
+	rule.pattern = line
+	return rule
+}
+
+func (rule *ignoreRule) match(rel string) bool {
+	if !rule.anchored {
+		pattern := strings.Replace(rule.pattern, "**", "*", -1)
+		matched, _ := path.Match(pattern, path.Base(rel))
+		return matched
+	}
+	return matchSegments(strings.Split(rule.pattern, "/"), strings.Split(rel, "/"))
+}
+
+func matchSegments(patterns []string, names []string) bool {
+	for len(patterns) > 0 {
+		if patterns[0] == "**" {
+			if len(patterns) == 1 {
+				return true
+			}
+			for i := 0; i <= len(names); i++ {
+				if matchSegments(patterns[1:], names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(names) == 0 {
+			return false
+		}
+		matched, err := path.Match(patterns[0], names[0])
+		if err != nil || !matched {
+			return false
+		}
+		patterns = patterns[1:]
+		names = names[1:]
+	}
+	return len(names) == 0
+}
@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestIgnorerMatch(t *testing.T) {
+	ig := NewIgnorer()
+	ig.AddPatterns("/p", []string{
+		"# comment",
+		"",
+		"*.log",
+		"!keep.log",
+		"build/",
+		"/vendor",
+		"doc/*.txt",
+		"**/testdata",
+		"a/**/z",
+		"\\#hash",
+		"space\\ ",
+	})
+	ig.AddPatterns("/p/sub", []string{
+		"local",
+		"!/vendor",
+	})
+
+	tests := []struct {
+		localPath string
+		isDir     bool
+		want      bool
+	}{
+		{"/p/x.log", false, true},
+		{"/p/deep/x.log", false, true},
+		{"/p/keep.log", false, false},
+		{"/p/deep/keep.log", false, false},
+		{"/p/x.go", false, false},
+		{"/p/build", true, true},
+		{"/p/build", false, false},
+		{"/p/deep/build", true, true},
+		{"/p/vendor", true, true},
+		{"/p/deep/vendor", true, false},
+		{"/p/doc/a.txt", false, true},
+		{"/p/doc/x/a.txt", false, false},
+		{"/p/testdata", true, true},
+		{"/p/x/y/testdata", true, true},
+		{"/p/a/z", true, true},
+		{"/p/a/b/c/z", false, true},
+		{"/p/b/z", false, false},
+		{"/p/#hash", false, true},
+		{"/p/space ", false, true},
+		{"/p/local", false, false},
+		{"/p/sub/local", false, true},
+		{"/p/sub/x/local", false, true},
+		{"/p/sub/vendor", true, false},
+		{"/other/x.log", false, false},
+	}
+	for _, tt := range tests {
+		got := ig.Match(tt.localPath, tt.isDir)
+		if got != tt.want {
+			t.Errorf("Match(%q, %v) = %v, want %v", tt.localPath, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestIgnorerNil(t *testing.T) {
+	var ig *Ignorer
+	if ig.Match("/p/x.log", false) {
+		t.Error("nil Ignorer matched")
+	}
+}
@@ -2,93 +2,269 @@ package utils
 
 import (
 	"fmt"
-	"go/parser"
+	"go/build"
 	"go/token"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 )
 
-func GetTotalImportList(path string, goPaths ...string) ([]string, error) {
-	if len(goPaths) == 0 {
+type BuildTarget struct {
+	GOOS       string
+	GOARCH     string
+	Tags       []string
+	Tests      bool
+	CgoEnabled bool
+}
+
+type ImportSource struct {
+	Package string
+	File    string
+}
+
+type Dependency struct {
+	ImportPath string
+	Dir        string
+	ImportedBy []*ImportSource
+}
+
+func (dep *Dependency) String() string {
+	if len(dep.ImportedBy) == 0 {
+		return dep.ImportPath
+	}
+	by := make([]string, 0, len(dep.ImportedBy))
+	for _, v := range dep.ImportedBy {
+		by = append(by, fmt.Sprintf("%s (%s)", v.Package, filepath.Base(v.File)))
+	}
+	return fmt.Sprintf("%s imported by %s", dep.ImportPath, strings.Join(by, ", "))
+}
+
+func GetTotalImportList(path string, Recursive bool, Target *BuildTarget, Modules []*Module, goPaths ...string) ([]*Dependency, error) {
+	if len(goPaths) == 0 && len(Modules) == 0 {
 		goPaths = []string{os.Getenv("GOPATH")}
 	}
 
-	importList, err := GetImportList(path, nil, goPaths)
+	path, err := filepath.Abs(path)
 	if err != nil {
 		return nil, err
 	}
-	pathHash := make(map[string]bool)
+
+	ctx := NewBuildContext(Target)
+
+	rootDirs := []string{path}
+	if Recursive {
+		rootDirs, err = GetPackageDirs(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	depHash := make(map[string]*Dependency)
+	visitHash := make(map[string]bool)
+	importList := make([]*Dependency, 0)
+	for _, dir := range rootDirs {
+		pkgPath := importPathOfDir(dir, Modules, goPaths)
+		list, err := GetImportList(ctx, dir, pkgPath, Target != nil && Target.Tests, visitHash, depHash, Modules, goPaths)
+		if err != nil {
+			return nil, err
+		}
+		importList = append(importList, list...)
+	}
 	for len(importList) > 0 {
-		subList := make([]string, 0)
+		subList := make([]*Dependency, 0)
 		for _, v := range importList {
-			list, err := GetImportList(v, pathHash, goPaths)
+			list, err := GetImportList(ctx, v.Dir, v.ImportPath, false, visitHash, depHash, Modules, goPaths)
 			if err != nil {
 				return nil, err
 			}
-			if len(list) > 0 {
-				subList = append(subList, list...)
-			}
+			subList = append(subList, list...)
 		}
 		importList = subList
 	}
-	totalImportList := make([]string, 0)
-	for key, _ := range pathHash {
-		totalImportList = append(totalImportList, key)
+
+	totalImportList := make([]*Dependency, 0, len(depHash))
+	for _, v := range depHash {
+		totalImportList = append(totalImportList, v)
 	}
+	sort.Slice(totalImportList, func(i, j int) bool {
+		return totalImportList[i].Dir < totalImportList[j].Dir
+	})
 	return totalImportList, nil
 }
 
-func GetImportList(path string, pathHash map[string]bool, goPaths []string) ([]string, error) {
-	var err error
-	path, err = filepath.Abs(path)
+func GetImportList(ctx *build.Context, dir string, pkgPath string, includeTests bool, visitHash map[string]bool, depHash map[string]*Dependency, Modules []*Module, goPaths []string) ([]*Dependency, error) {
+	if visitHash[dir] {
+		return nil, nil
+	}
+	visitHash[dir] = true
+
+	pkg, err := ctx.ImportDir(dir, 0)
 	if err != nil {
+		if _, ok := err.(*build.NoGoError); ok {
+			return nil, nil
+		}
 		return nil, err
 	}
 
-	importList := make([]string, 0)
-	isVisited := false
-	if pathHash != nil {
-		if _, has := pathHash[path]; has {
-			isVisited = true
-		}
-	}
-
-	if !isVisited {
-		if _, err := os.Stat(path); err == nil {
-			filepath.Walk(path, func(subpath string, finfo os.FileInfo, err error) error {
-				if !finfo.IsDir() {
-					ext := filepath.Ext(subpath)
-					if ext == ".go" {
-						fset := token.NewFileSet()
-						f, err := parser.ParseFile(fset, subpath, nil, 0)
-						if err != nil {
-							return err
-						}
-
-						for _, v := range f.Imports {
-							for _, goPath := range goPaths {
-								Len := len(v.Path.Value)
-								src := fmt.Sprintf("%s/src/%s", goPath, v.Path.Value[1:Len-1])
-								_, err := os.Stat(src)
-								if err != nil {
-									if os.IsNotExist(err) {
-										continue
-									} else {
-										return err
-									}
-								}
-								importList = append(importList, src)
-							}
-						}
-					}
-				}
-				return nil
-			})
+	imports := pkg.Imports
+	importPos := pkg.ImportPos
+	if includeTests {
+		imports = append(append(append([]string{}, imports...), pkg.TestImports...), pkg.XTestImports...)
+		importPos = make(map[string][]token.Position)
+		for _, posHash := range []map[string][]token.Position{pkg.ImportPos, pkg.TestImportPos, pkg.XTestImportPos} {
+			for k, v := range posHash {
+				importPos[k] = append(importPos[k], v...)
+			}
+		}
+	}
 
-			if pathHash != nil {
-				pathHash[path] = true
+	importList := make([]*Dependency, 0)
+	for _, importPath := range imports {
+		if importPath == "C" || build.IsLocalImport(importPath) {
+			continue
+		}
+
+		src, has := resolveImport(dir, importPath, Modules, goPaths)
+		if !has {
+			continue
+		}
+
+		dep, has := depHash[src]
+		if !has {
+			dep = &Dependency{
+				ImportPath: importPath,
+				Dir:        src,
 			}
+			depHash[src] = dep
+			importList = append(importList, dep)
+		}
+		for _, pos := range importPos[importPath] {
+			dep.ImportedBy = append(dep.ImportedBy, &ImportSource{
+				Package: pkgPath,
+				File:    pos.Filename,
+			})
 		}
 	}
 	return importList, nil
 }
+
+func NewBuildContext(Target *BuildTarget) *build.Context {
+	ctx := build.Default
+	if Target != nil {
+		if len(Target.GOOS) > 0 {
+			ctx.GOOS = Target.GOOS
+		}
+		if len(Target.GOARCH) > 0 {
+			ctx.GOARCH = Target.GOARCH
+		}
+		ctx.BuildTags = Target.Tags
+		ctx.CgoEnabled = Target.CgoEnabled
+	} else {
+		ctx.CgoEnabled = true
+	}
+	return &ctx
+}
+
+func GetPackageDirs(root string) ([]string, error) {
+	dirs := make([]string, 0)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if path != root {
+			name := info.Name()
+			if name == "vendor" || name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+				return filepath.SkipDir
+			}
+			if _, err := os.Stat(filepath.Join(path, "go.mod")); err == nil {
+				return filepath.SkipDir
+			}
+		}
+		dirs = append(dirs, path)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dirs, nil
+}
+
+func ParseBuildTags(BuildFlags []string) []string {
+	var value string
+	for i, v := range BuildFlags {
+		if v == "-tags" || v == "--tags" {
+			if i+1 < len(BuildFlags) {
+				value = BuildFlags[i+1]
+			}
+		} else if strings.HasPrefix(v, "-tags=") || strings.HasPrefix(v, "--tags=") {
+			value = v[strings.Index(v, "=")+1:]
+		}
+	}
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
+
+func resolveImport(dir string, importPath string, Modules []*Module, goPaths []string) (string, bool) {
+	if len(goPaths) > 0 {
+		if src, has := findVendorImport(dir, importPath, goPaths); has {
+			return src, true
+		}
+	}
+	if src, has := ResolveModuleImport(importPath, Modules); has {
+		if _, err := os.Stat(src); err == nil {
+			return src, true
+		}
+		return "", false
+	}
+	for _, goPath := range goPaths {
+		src := filepath.Join(goPath, "src", filepath.FromSlash(importPath))
+		if _, err := os.Stat(src); err == nil {
+			return src, true
+		}
+	}
+	return "", false
+}
+
+func importPathOfDir(dir string, Modules []*Module, goPaths []string) string {
+	if m := ModuleOfDir(dir, Modules); m != nil {
+		rel, err := filepath.Rel(m.Dir, dir)
+		if err == nil {
+			if rel == "." {
+				return m.Path
+			}
+			return m.Path + "/" + filepath.ToSlash(rel)
+		}
+	}
+	for _, goPath := range goPaths {
+		rel, err := filepath.Rel(filepath.Join(goPath, "src"), dir)
+		if err == nil && !strings.HasPrefix(rel, "..") {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return filepath.ToSlash(dir)
+}
+
+func findVendorImport(dir string, importPath string, goPaths []string) (string, bool) {
+	for {
+		src := filepath.Join(dir, "vendor", filepath.FromSlash(importPath))
+		if _, err := os.Stat(src); err == nil {
+			return src, true
+		}
+
+		for _, goPath := range goPaths {
+			if dir == filepath.Join(goPath, "src") {
+				return "", false
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
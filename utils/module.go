@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrNoModulePath = errors.New("no module path in go.mod")
+)
+
+type Module struct {
+	Path    string
+	Version string
+	Dir     string
+	Main    bool
+	Replace *Module
+}
+
+func FindModule(dir string) (*Module, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		gomod := filepath.Join(dir, "go.mod")
+		if _, err := os.Stat(gomod); err == nil {
+			modPath, err := ReadModulePath(gomod)
+			if err != nil {
+				return nil, err
+			}
+			return &Module{
+				Path: modPath,
+				Dir:  dir,
+			}, nil
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, nil
+		}
+		dir = parent
+	}
+}
+
+func ReadModulePath(gomod string) (string, error) {
+	file, err := os.Open(gomod)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.Index(line, "//"); idx >= 0 {
+			line = line[:idx]
+		}
+		line = strings.TrimSpace(line)
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "module" {
+			continue
+		}
+		line = strings.TrimSpace(line[len("module"):])
+		if line[0] == '"' || line[0] == '`' {
+			modPath, err := strconv.Unquote(line)
+			if err != nil {
+				return "", err
+			}
+			return modPath, nil
+		}
+		return line, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", ErrNoModulePath
+}
+
+func ResolveModuleImport(importPath string, Modules []*Module) (string, bool) {
+	var found *Module
+	for _, m := range Modules {
+		if len(m.Dir) == 0 {
+			continue
+		}
+		if importPath == m.Path || strings.HasPrefix(importPath, m.Path+"/") {
+			if found == nil || len(m.Path) > len(found.Path) {
+				found = m
+			}
+		}
+	}
+	if found == nil {
+		return "", false
+	}
+	rel := strings.TrimPrefix(importPath, found.Path)
+	return filepath.Join(found.Dir, filepath.FromSlash(rel)), true
+}
+
+func ModuleOfDir(dir string, Modules []*Module) *Module {
+	var found *Module
+	for _, m := range Modules {
+		if len(m.Dir) == 0 {
+			continue
+		}
+		if dir == m.Dir || strings.HasPrefix(dir, m.Dir+string(filepath.Separator)) {
+			if found == nil || len(m.Dir) > len(found.Dir) {
+				found = m
+			}
+		}
+	}
+	return found
+}
+
+func ListModules(dir string) ([]*Module, error) {
+	cmd := exec.Command("go", "list", "-m", "-json", "all")
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list -m all: %v: %s", err, stderr.String())
+	}
+
+	Modules := make([]*Module, 0)
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var m Module
+		err := dec.Decode(&m)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		Modules = append(Modules, &m)
+	}
+	return Modules, nil
+}
+
+func GoEnv(key string) (string, error) {
+	out, err := exec.Command("go", "env", key).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func EscapeModulePath(modPath string) string {
+	var buffer bytes.Buffer
+	for _, r := range modPath {
+		if 'A' <= r && r <= 'Z' {
+			buffer.WriteByte('!')
+			buffer.WriteRune(r + ('a' - 'A'))
+		} else {
+			buffer.WriteRune(r)
+		}
+	}
+	return buffer.String()
+}
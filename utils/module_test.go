@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestEscapeModulePath(t *testing.T) {
+	tests := []struct {
+		modPath string
+		want    string
+	}{
+		{"golang.org/x/sys", "golang.org/x/sys"},
+		{"github.com/Azure/azure-sdk-for-go", "github.com/!azure/azure-sdk-for-go"},
+		{"github.com/BurntSushi/TOML", "github.com/!burnt!sushi/!t!o!m!l"},
+		{"v1.2.3-RC1", "v1.2.3-!r!c1"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got := EscapeModulePath(tt.modPath)
+		if got != tt.want {
+			t.Errorf("EscapeModulePath(%q) = %q, want %q", tt.modPath, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+type SpoolFile struct {
+	*os.File
+}
+
+func NewSpoolFile() (*SpoolFile, error) {
+	file, err := ioutil.TempFile("", "devfarm_spool")
+	if err != nil {
+		return nil, err
+	}
+	return &SpoolFile{File: file}, nil
+}
+
+func Spool(r io.Reader) (*SpoolFile, error) {
+	sf, err := NewSpoolFile()
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(sf, r)
+	if err != nil {
+		sf.Close()
+		return nil, err
+	}
+	return sf, nil
+}
+
+func (sf *SpoolFile) Size() (int64, error) {
+	info, err := sf.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (sf *SpoolFile) Close() error {
+	err := sf.File.Close()
+	os.Remove(sf.Name())
+	return err
+}
@@ -0,0 +1,17 @@
+package utils
+
+import (
+	"os"
+	"os/user"
+)
+
+func CurrentUser() string {
+	if name := os.Getenv("DEVFARM_USER"); len(name) > 0 {
+		return name
+	}
+	u, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return u.Username
+}
@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+type ModuleVersion struct {
+	Path    string
+	Version string
+}
+
+type Replace struct {
+	Old ModuleVersion
+	New ModuleVersion
+}
+
+type Workspace struct {
+	Go  string
+	Use []struct {
+		DiskPath string
+	}
+	Replace []*Replace
+}
+
+func FindWorkspace(dir string) (string, error) {
+	cmd := exec.Command("go", "env", "GOWORK")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	workFile := string(bytes.TrimSpace(out))
+	if workFile == "off" {
+		workFile = ""
+	}
+	return workFile, nil
+}
+
+func ReadWorkspace(workFile string) (*Workspace, error) {
+	out, err := goEditJSON("work", workFile)
+	if err != nil {
+		return nil, err
+	}
+	var ws Workspace
+	err = json.Unmarshal(out, &ws)
+	if err != nil {
+		return nil, err
+	}
+	return &ws, nil
+}
+
+func ReadModuleReplaces(gomod string) ([]*Replace, error) {
+	out, err := goEditJSON("mod", gomod)
+	if err != nil {
+		return nil, err
+	}
+	var mf struct {
+		Replace []*Replace
+	}
+	err = json.Unmarshal(out, &mf)
+	if err != nil {
+		return nil, err
+	}
+	return mf.Replace, nil
+}
+
+func EditModFile(gomod string, Edits []string) ([]byte, error) {
+	data, err := ioutil.ReadFile(gomod)
+	if err != nil {
+		return nil, err
+	}
+	if len(Edits) == 0 {
+		return data, nil
+	}
+
+	tempDir, err := ioutil.TempDir("", "devfarm_packer")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	tempFile := filepath.Join(tempDir, "go.mod")
+	err = ioutil.WriteFile(tempFile, data, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	Args := append([]string{"mod", "edit"}, Edits...)
+	Args = append(Args, tempFile)
+	cmd := exec.Command("go", Args...)
+	cmd.Dir = tempDir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("go mod edit: %v: %s", err, out)
+	}
+	return ioutil.ReadFile(tempFile)
+}
+
+func (r *Replace) IsLocal() bool {
+	return len(r.New.Version) == 0
+}
+
+func (r *Replace) OldString() string {
+	if len(r.Old.Version) > 0 {
+		return r.Old.Path + "@" + r.Old.Version
+	}
+	return r.Old.Path
+}
+
+func goEditJSON(kind string, file string) ([]byte, error) {
+	cmd := exec.Command("go", kind, "edit", "-json", file)
+	cmd.Dir = filepath.Dir(file)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go %s edit: %v: %s", kind, err, stderr.String())
+	}
+	return out, nil
+}
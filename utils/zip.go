@@ -2,48 +2,228 @@ package utils
 
 import (
 	"archive/zip"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
-func AddDirToZip(zw *zip.Writer, localPath string, prefix string, ignorePrefix []string) error {
-	if len(prefix) > 0 {
-		prefix = prefix + "/"
+var (
+	ZipModTime = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+)
+
+var (
+	ErrInvalidPath = errors.New("invalid archive path")
+)
+
+// CleanArchivePath cleans Path of an archive entry and rejects the ones which are absolute,
+// climb out of the archive root with .. or, when Prefixes are given, start with none of them.
+func CleanArchivePath(Path string, Prefixes ...string) (string, error) {
+	clean := path.Clean(Path)
+	if len(Path) == 0 || path.IsAbs(clean) || filepath.IsAbs(Path) || clean == "." {
+		return "", fmt.Errorf("%v: %s", ErrInvalidPath, Path)
 	}
-	prefix = filepath.ToSlash(prefix)
-	err := filepath.Walk(localPath, func(path string, info os.FileInfo, err error) error {
-		rel, err := filepath.Rel(localPath, path)
-		if err != nil {
-			return err
+	for _, v := range strings.Split(clean, "/") {
+		if v == ".." {
+			return "", fmt.Errorf("%v: %s", ErrInvalidPath, Path)
 		}
-		rel = filepath.ToSlash(rel)
-		path = filepath.ToSlash(path)
-		if info != nil && !info.IsDir() {
-			for _, v := range ignorePrefix {
-				if strings.HasPrefix(filepath.ToSlash(rel), filepath.ToSlash(v)) {
-					return nil
-				}
-			}
-			fw, err := zw.Create(prefix + rel)
+	}
+	if len(Prefixes) == 0 {
+		return clean, nil
+	}
+	for _, prefix := range Prefixes {
+		if strings.HasPrefix(clean, prefix) {
+			return clean, nil
+		}
+	}
+	return "", fmt.Errorf("%v: %s", ErrInvalidPath, Path)
+}
+
+func AddDirToZip(zw *zip.Writer, localPath string, prefix string, ig *Ignorer) error {
+	var fl FileList
+	err := fl.AddDir(localPath, prefix, ig)
+	if err != nil {
+		return err
+	}
+	return WriteEntriesToZip(zw, fl.Entries)
+}
+
+func WriteEntriesToZip(zw *zip.Writer, Entries []*FileEntry) error {
+	fl := &FileList{Entries: append([]*FileEntry{}, Entries...)}
+	fl.Sort()
+	for _, fe := range fl.Entries {
+		err := func() error {
+			r, err := fe.Open()
 			if err != nil {
 				return err
 			}
-			file, err := os.Open(path)
+			defer r.Close()
+
+			return CopyToZip(zw, fe.Path, fe.Mode, r)
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func CopyToZip(zw *zip.Writer, name string, mode os.FileMode, r io.Reader) error {
+	fw, err := zw.CreateHeader(NewZipHeader(name, mode))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, r)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func NewZipHeader(name string, mode os.FileMode) *zip.FileHeader {
+	fh := &zip.FileHeader{
+		Name:     filepath.ToSlash(name),
+		Method:   zip.Deflate,
+		Modified: ZipModTime,
+	}
+	if mode == 0 {
+		mode = 0644
+	}
+	fh.SetMode(NormalizeMode(mode))
+	if mode&os.ModeSymlink != 0 {
+		fh.Method = zip.Store
+	}
+	return fh
+}
+
+// WriteZipEntry writes the entry name of an archive under Root, creating its parent directories.
+// It never writes through a symlink, and a symlink must be relative and stay inside Root.
+func WriteZipEntry(Root string, name string, mode os.FileMode, r io.Reader) error {
+	name, err := CleanArchivePath(name)
+	if err != nil {
+		return err
+	}
+	err = mkdirInRoot(Root, path.Dir(name))
+	if err != nil {
+		return err
+	}
+	dest := filepath.Join(Root, filepath.FromSlash(name))
+
+	if mode&os.ModeSymlink != 0 {
+		target, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		Target := filepath.ToSlash(string(target))
+		if path.IsAbs(Target) || filepath.IsAbs(string(target)) {
+			return fmt.Errorf("%v: %s -> %s", ErrInvalidPath, name, target)
+		}
+		if joined := path.Join(path.Dir(name), Target); joined == ".." || strings.HasPrefix(joined, "../") {
+			return fmt.Errorf("%v: %s -> %s", ErrInvalidPath, name, target)
+		}
+		return os.Symlink(filepath.FromSlash(Target), dest)
+	}
+
+	if info, err := os.Lstat(dest); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("%v: %s is a symlink", ErrInvalidPath, name)
+	}
+	file, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, NormalizeMode(mode).Perm())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(file, r)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// CheckSymlinks checks that the symlinks among names, written by WriteZipEntry, resolve inside Root
+// now that all the entries are written, as a later link can change where an earlier one leads.
+func CheckSymlinks(Root string, names []string) error {
+	for _, name := range names {
+		info, err := os.Lstat(filepath.Join(Root, filepath.FromSlash(name)))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		err = resolveInRoot(Root, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mkdirInRoot(Root string, dir string) error {
+	if dir == "." {
+		return nil
+	}
+	cur := Root
+	for _, v := range strings.Split(dir, "/") {
+		cur = filepath.Join(cur, v)
+		info, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			err = os.Mkdir(cur, 0755)
 			if err != nil {
 				return err
 			}
-			defer file.Close()
-			_, err = io.Copy(fw, file)
-			if err != nil {
-				return err
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%v: %s is not a directory", ErrInvalidPath, dir)
+		}
+	}
+	return nil
+}
+
+// resolveInRoot follows name under Root like the kernel does, symlink by symlink,
+// and fails when it leaves Root. Missing components are taken as they are.
+func resolveInRoot(Root string, name string) error {
+	parts := strings.Split(name, "/")
+	cur := make([]string, 0)
+	links := 0
+	for len(parts) > 0 {
+		v := parts[0]
+		parts = parts[1:]
+		switch v {
+		case "", ".":
+			continue
+		case "..":
+			if len(cur) == 0 {
+				return fmt.Errorf("%v: %s leads outside", ErrInvalidPath, name)
 			}
+			cur = cur[:len(cur)-1]
+			continue
 		}
-		return nil
-	})
-	if err != nil {
-		return err
+		cur = append(cur, v)
+
+		full := filepath.Join(Root, filepath.FromSlash(strings.Join(cur, "/")))
+		info, err := os.Lstat(full)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		links++
+		if links > 255 {
+			return fmt.Errorf("%v: %s has too many links", ErrInvalidPath, name)
+		}
+		target, err := os.Readlink(full)
+		if err != nil {
+			return err
+		}
+		if filepath.IsAbs(target) {
+			return fmt.Errorf("%v: %s leads outside", ErrInvalidPath, name)
+		}
+		cur = cur[:len(cur)-1]
+		parts = append(strings.Split(filepath.ToSlash(target), "/"), parts...)
 	}
 	return nil
 }
@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCleanArchivePath(t *testing.T) {
+	prefixes := []string{"src/", "mod/", "__resources/", "bin/"}
+	tests := []struct {
+		Path     string
+		Prefixes []string
+		want     string
+		wantErr  bool
+	}{
+		{"src/a/b.go", prefixes, "src/a/b.go", false},
+		{"src/a/./b.go", prefixes, "src/a/b.go", false},
+		{"src//a/b.go", prefixes, "src/a/b.go", false},
+		{"mod/cache/download/x/@v/v1.0.0.zip", prefixes, "mod/cache/download/x/@v/v1.0.0.zip", false},
+		{"__resources/config.json", prefixes, "__resources/config.json", false},
+		{"src/../../../etc/cron.d/x", prefixes, "", true},
+		{"src/a/../../etc/passwd", prefixes, "", true},
+		{"src/a/../b.go", prefixes, "src/b.go", false},
+		{"/etc/passwd", prefixes, "", true},
+		{"/src/a.go", prefixes, "", true},
+		{"etc/passwd", prefixes, "", true},
+		{"srcx/a.go", prefixes, "", true},
+		{"", prefixes, "", true},
+		{".", nil, "", true},
+		{"..", nil, "", true},
+		{"prog", nil, "prog", false},
+		{"linux_arm64/prog", nil, "linux_arm64/prog", false},
+		{"../prog", nil, "", true},
+	}
+	for _, tt := range tests {
+		got, err := CleanArchivePath(tt.Path, tt.Prefixes...)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("CleanArchivePath(%q) error = %v, wantErr %v", tt.Path, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("CleanArchivePath(%q) = %q, want %q", tt.Path, got, tt.want)
+		}
+	}
+}
+
+type zipEntry struct {
+	name   string
+	mode   os.FileMode
+	data   string
+	reject bool
+}
+
+func writeEntries(t *testing.T, Root string, entries []zipEntry) error {
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		err := WriteZipEntry(Root, e.name, e.mode, strings.NewReader(e.data))
+		if (err != nil) != e.reject {
+			t.Fatalf("WriteZipEntry(%q -> %q) error = %v, reject %v", e.name, e.data, err, e.reject)
+		}
+		if err == nil {
+			names = append(names, e.name)
+		}
+	}
+	return CheckSymlinks(Root, names)
+}
+
+func TestWriteZipEntry(t *testing.T) {
+	tests := []struct {
+		name     string
+		entries  []zipEntry
+		checkErr bool
+	}{
+		{"files and dirs", []zipEntry{
+			{name: "src/a/main.go", mode: 0644, data: "package main"},
+			{name: "src/a/b/c.go", mode: 0644, data: "package b"},
+		}, false},
+		{"relative link inside", []zipEntry{
+			{name: "src/a/x.go", mode: 0644, data: "package a"},
+			{name: "src/b/x.go", mode: os.ModeSymlink, data: "../a/x.go"},
+		}, false},
+		{"absolute link", []zipEntry{
+			{name: "src/x", mode: os.ModeSymlink, data: "/", reject: true},
+		}, false},
+		{"link outside", []zipEntry{
+			{name: "src/x", mode: os.ModeSymlink, data: "../../etc", reject: true},
+		}, false},
+		{"write through link", []zipEntry{
+			{name: "src/x", mode: os.ModeSymlink, data: "../mod"},
+			{name: "src/x/etc/passwd", mode: 0644, data: "root", reject: true},
+		}, false},
+		{"overwrite link", []zipEntry{
+			{name: "src/f", mode: 0644, data: "a"},
+			{name: "src/l", mode: os.ModeSymlink, data: "f"},
+			{name: "src/l", mode: 0644, data: "b", reject: true},
+		}, false},
+		{"escape by chain", []zipEntry{
+			{name: "src/d/b", mode: os.ModeSymlink, data: "../.."},
+			{name: "src/d/c", mode: os.ModeSymlink, data: "b/../x"},
+		}, true},
+		{"escape by later link", []zipEntry{
+			{name: "src/a", mode: os.ModeSymlink, data: "b/../../x"},
+			{name: "src/b", mode: os.ModeSymlink, data: ".."},
+		}, true},
+		{"link loop", []zipEntry{
+			{name: "src/a", mode: os.ModeSymlink, data: "b"},
+			{name: "src/b", mode: os.ModeSymlink, data: "a"},
+		}, true},
+	}
+	for _, tt := range tests {
+		Root, err := ioutil.TempDir("", "devfarm_zip")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = writeEntries(t, Root, tt.entries)
+		if (err != nil) != tt.checkErr {
+			t.Errorf("%s: CheckSymlinks error = %v, want error %v", tt.name, err, tt.checkErr)
+		}
+		if _, err := os.Lstat(filepath.Join(filepath.Dir(Root), "etc")); err == nil {
+			t.Errorf("%s: wrote outside the root", tt.name)
+		}
+		os.RemoveAll(Root)
+	}
+}